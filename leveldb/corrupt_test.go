@@ -33,8 +33,9 @@ func newDbCorruptHarnessWopt(t *testing.T, o *opt.Options) *dbCorruptHarness {
 
 func newDbCorruptHarness(t *testing.T) *dbCorruptHarness {
 	return newDbCorruptHarnessWopt(t, &opt.Options{
-		BlockCacheCapacity: 100,
-		Strict:             opt.StrictJournalChecksum,
+		BlockCacheCapacity:     100,
+		DisableValueSeparation: true,
+		Strict:                 opt.StrictJournalChecksum,
 	})
 }
 
@@ -200,6 +201,40 @@ func (h *dbCorruptHarness) removeOne(ft storage.FileType) {
 	}
 }
 
+// lsmValueLens returns the length of the shortest and the longest LSM value
+// of the first n keys written by build; their values must be separated.
+func (h *dbCorruptHarness) lsmValueLens(n int) (min, max int) {
+	for i := 0; i < n; i++ {
+		v := h.lsmValue(string(tkey(i)))
+		if !isValuePointer(v) {
+			h.t.Fatalf("value of %q not separated", tkey(i))
+		}
+		if i == 0 || len(v) < min {
+			min = len(v)
+		}
+		if len(v) > max {
+			max = len(v)
+		}
+	}
+	return
+}
+
+// blockEntries returns the least and the most entries a data block of the
+// given size holds, of the first n keys written by build. The table must be
+// written with BlockRestartInterval 1, so that every entry takes 3 bytes of
+// lengths, the internal key, the LSM value and a 4-byte restart point, see
+// table.Writer.
+func (h *dbCorruptHarness) blockEntries(n, blockSize int) (min, max int) {
+	vmin, vmax := h.lsmValueLens(n)
+	entries := func(vlen int) int {
+		e := 3 + len(tkey(0)) + 8 + vlen + 4
+		// A block is finished once it reaches the block size, its
+		// 4-byte restart count included.
+		return (blockSize - 4 + e - 1) / e
+	}
+	return entries(vmax), entries(vmin)
+}
+
 func (h *dbCorruptHarness) check(min, max int) {
 	p := &h.dbHarness
 	t := p.t
@@ -260,6 +295,60 @@ func TestCorruptDB_Table(t *testing.T) {
 	h.check(99, 99)
 }
 
+func newDbCorruptHarnessSeparated(t *testing.T, blockSize int) *dbCorruptHarness {
+	return newDbCorruptHarnessWopt(t, &opt.Options{
+		BlockCacheCapacity:   100,
+		BlockSize:            blockSize,
+		BlockRestartInterval: 1,
+		Compression:          opt.NoCompression,
+		Strict:               opt.StrictJournalChecksum | opt.StrictBlockChecksum,
+	})
+}
+
+func TestCorruptDB_JournalSeparated(t *testing.T) {
+	h := newDbCorruptHarnessSeparated(t, 4*opt.KiB)
+	defer h.close()
+
+	const n = 3000
+	h.build(n)
+	h.check(n, n)
+	vmin, vmax := h.lsmValueLens(n)
+	h.closeDB()
+	h.corrupt(storage.TypeJournal, -1, 19, 1)
+	h.corrupt(storage.TypeJournal, -1, 32*1024+1000, 1)
+
+	// Every write is a journal record of a 7-byte chunk header and a batch:
+	// a 12-byte header and one record of a type byte, the key and the LSM
+	// value, both length-prefixed. The records of the first block are lost,
+	// and those of the second block from its corrupted byte on.
+	record := func(vlen int) int {
+		return 7 + 12 + 1 + 1 + len(tkey(0)) + 1 + vlen
+	}
+	lostMin := (2*32*1024-1000)/record(vmax) - 2
+	lostMax := 2*32*1024/record(vmin) + 1
+
+	h.openDB()
+	h.check(n-lostMax, n-lostMin)
+}
+
+func TestCorruptDB_TableSeparated(t *testing.T) {
+	const blockSize = 128
+	h := newDbCorruptHarnessSeparated(t, blockSize)
+	defer h.close()
+
+	h.build(100)
+	h.compactMem()
+	h.compactRangeAt(0, "", "")
+	h.compactRangeAt(1, "", "")
+	min, max := h.blockEntries(100, blockSize)
+	h.closeDB()
+	// The block holding the corrupted byte is lost, the others are read.
+	h.corrupt(storage.TypeTable, -1, 100, 1)
+
+	h.openDB()
+	h.check(100-max, 100-min)
+}
+
 func TestCorruptDB_TableIndex(t *testing.T) {
 	h := newDbCorruptHarness(t)
 	defer h.close()
@@ -383,6 +472,24 @@ func TestCorruptDB_CompactionInputError(t *testing.T) {
 	h.check(10000, 10000)
 }
 
+func TestCorruptDB_CompactionInputErrorSeparated(t *testing.T) {
+	const blockSize = 128
+	h := newDbCorruptHarnessSeparated(t, blockSize)
+	defer h.close()
+
+	h.build(10)
+	h.compactMem()
+	min, max := h.blockEntries(10, blockSize)
+	h.closeDB()
+	h.corrupt(storage.TypeTable, -1, 100, 1)
+
+	h.openDB()
+	h.check(10-max, 10-min)
+
+	h.build(10000)
+	h.check(10000, 10000)
+}
+
 func TestCorruptDB_UnrelatedKeys(t *testing.T) {
 	h := newDbCorruptHarness(t)
 	defer h.close()
@@ -471,9 +578,10 @@ func TestCorruptDB_MissingTableFiles(t *testing.T) {
 
 func TestCorruptDB_RecoverTable(t *testing.T) {
 	h := newDbCorruptHarnessWopt(t, &opt.Options{
-		WriteBuffer:         112 * opt.KiB,
-		CompactionTableSize: 90 * opt.KiB,
-		Filter:              filter.NewBloomFilter(10),
+		WriteBuffer:            112 * opt.KiB,
+		CompactionTableSize:    90 * opt.KiB,
+		DisableValueSeparation: true,
+		Filter:                 filter.NewBloomFilter(10),
 	})
 	defer h.close()
 
@@ -496,3 +604,38 @@ func TestCorruptDB_RecoverTable(t *testing.T) {
 	}
 	h.check(985, 985)
 }
+
+func TestCorruptDB_RecoverTableSeparated(t *testing.T) {
+	const blockSize = 256
+	h := newDbCorruptHarnessWopt(t, &opt.Options{
+		BlockSize:            blockSize,
+		BlockRestartInterval: 1,
+		Compression:          opt.NoCompression,
+		WriteBuffer:          112 * opt.KiB,
+		CompactionTableSize:  4 * opt.KiB,
+	})
+	defer h.close()
+
+	h.build(1000)
+	h.compactMem()
+	h.compactRangeAt(0, "", "")
+	h.compactRangeAt(1, "", "")
+	seq := h.db.seq
+	min, max := h.blockEntries(1000, blockSize)
+	time.Sleep(100 * time.Millisecond) // Wait lazy reference finish tasks
+	h.closeDB()
+	// Corrupt a data block of three tables, none of them the last block of
+	// its table.
+	if fds, _ := h.stor.List(storage.TypeTable); len(fds) < 7 {
+		t.Fatalf("got %d tables, want at least 7", len(fds))
+	}
+	h.corrupt(storage.TypeTable, 0, 100, 1)
+	h.corrupt(storage.TypeTable, 3, 3*blockSize, 1)
+	h.corrupt(storage.TypeTable, 5, 100, 1)
+
+	h.recover()
+	if h.db.seq != seq {
+		t.Errorf("invalid seq, want=%d got=%d", seq, h.db.seq)
+	}
+	h.check(1000-3*max, 1000-3*min)
+}
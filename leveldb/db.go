@@ -8,6 +8,7 @@ package leveldb
 
 import (
 	"container/list"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -48,6 +49,9 @@ type DB struct {
 	// Session.
 	s *session
 
+	// Result of the value check of Recover.
+	recoveryReport *ValueLogReport
+
 	// MemDB.
 	memMu           sync.RWMutex
 	memPool         chan *memdb.DB
@@ -85,10 +89,11 @@ type DB struct {
 	memdbMaxLevel    int // For testing.
 
 	// Close.
-	closeW sync.WaitGroup
-	closeC chan struct{}
-	closed uint32
-	closer io.Closer
+	closeW  sync.WaitGroup
+	closeC  chan struct{}
+	closeMu sync.RWMutex // Held by Close while setting closed.
+	closed  uint32
+	closer  io.Closer
 }
 
 func openDB(s *session) (*DB, error) {
@@ -169,19 +174,25 @@ func openDB(s *session) (*DB, error) {
 // Also, if ErrorIfExist is true and the DB exist Open will returns
 // os.ErrExist error.
 //
+// The value log is kept in the given storage as well, unless
+// Options.ValueStorage says otherwise.
+//
 // Open will return an error with type of ErrCorrupted if corruption
 // detected in the DB. Use errors.IsCorrupted to test whether an error is
 // due to corruption. Corrupted DB can be recovered with Recover function.
 //
 // The returned DB instance is safe for concurrent use.
 // The DB must be closed after use, by calling Close method.
-func Open(stor storage.Storage, vStore *vStorage, o *opt.Options) (db *DB, err error) {
-	s, err := newSession(stor, vStore, o)
+func Open(stor storage.Storage, o *opt.Options) (db *DB, err error) {
+	s, err := newSession(stor, o)
 	if err != nil {
 		return
 	}
 	defer func() {
 		if err != nil {
+			if s.vStore != nil {
+				s.vStore.Close()
+			}
 			s.close()
 			s.release()
 		}
@@ -201,7 +212,24 @@ func Open(stor storage.Storage, vStore *vStorage, o *opt.Options) (db *DB, err e
 		return
 	}
 
-	return openDB(s)
+	s.vStore, err = openStore(valueStorage(stor, o), o, false)
+	if err != nil {
+		return
+	}
+	db, err = openDB(s)
+	if err != nil {
+		return
+	}
+	s.vStore.SetKeyStore(db)
+	return
+}
+
+// valueStorage returns the storage the value log is kept in.
+func valueStorage(stor storage.Storage, o *opt.Options) storage.Storage {
+	if vStor := o.GetValueStorage(); vStor != nil {
+		return vStor
+	}
+	return stor
 }
 
 // OpenFile opens or creates a DB for the given path.
@@ -210,7 +238,9 @@ func Open(stor storage.Storage, vStore *vStorage, o *opt.Options) (db *DB, err e
 // os.ErrExist error.
 //
 // OpenFile uses standard file-system backed storage implementation as
-// described in the leveldb/storage package.
+// described in the leveldb/storage package. The value log is kept in the
+// 'value' directory under the given path, unless Options.ValueStorage says
+// otherwise, and the rest of the DB in the 'key' directory.
 //
 // OpenFile will return an error with type of ErrCorrupted if corruption
 // detected in the DB. Use errors.IsCorrupted to test whether an error is
@@ -219,49 +249,119 @@ func Open(stor storage.Storage, vStore *vStorage, o *opt.Options) (db *DB, err e
 // The returned DB instance is safe for concurrent use.
 // The DB must be closed after use, by calling Close method.
 func OpenFile(path string, o *opt.Options) (db *DB, err error) {
-	kPath := pathpkg.Join(path, "key")
-	stor, err := storage.OpenFile(kPath, o.GetReadOnly())
-	vPath := pathpkg.Join(path, "value")
-	vStore := OpenStore(vPath)
+	stor, err := storage.OpenFile(pathpkg.Join(path, "key"), o.GetReadOnly())
 	if err != nil {
 		return
 	}
-	db, err = Open(stor, vStore, o)
-	vStore.SetKeyStore(db)
+	o, vStor, legacyPath, err := openValueStorage(path, o, o.GetReadOnly())
 	if err != nil {
 		stor.Close()
-	} else {
-		db.closer = stor
+		return
+	}
+	db, err = Open(stor, o)
+	if err != nil {
+		if vStor != nil {
+			vStor.Close()
+		}
+		stor.Close()
+		return
+	}
+	db.s.vStore.closer = vStor
+	db.closer = stor
+	if legacyPath != "" {
+		if err = db.migrateLegacyValues(legacyPath); err != nil {
+			db.Close()
+			db = nil
+		}
 	}
 	return
 }
 
+// openValueStorage opens the 'value' directory under the given path as
+// value storage, unless the given options name one already. It returns the
+// options to open the DB with, the storage if it was opened here and the
+// path of a legacy value log to migrate, see prepareLegacyValues.
+func openValueStorage(path string, o *opt.Options, readOnly bool) (*opt.Options, storage.Storage, string, error) {
+	if o.GetValueStorage() != nil {
+		return o, nil, "", nil
+	}
+	vPath := pathpkg.Join(path, "value")
+	legacyPath, err := prepareLegacyValues(vPath, readOnly)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	vStor, err := storage.OpenFile(vPath, readOnly)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	o = dupOptions(o)
+	o.ValueStorage = vStor
+	return o, vStor, legacyPath, nil
+}
+
 // Recover recovers and opens a DB with missing or corrupted manifest files
-// for the given storage. It will ignore any manifest files, valid or not.
+// for the given storage. It will ignore any manifest files, valid or not;
+// that of the value log included, which is rebuilt from the value files.
 // The DB must already exist or it will returns an error.
 // Also, Recover will ignore ErrorIfMissing and ErrorIfExist options.
 //
+// The keys whose values point at missing or truncated value log records are
+// reported by DB.RecoveryReport; those keys are left as they are, see
+// DB.VerifyValueLog to delete them.
+//
 // The returned DB instance is safe for concurrent use.
 // The DB must be closed after use, by calling Close method.
+func Recover(stor storage.Storage, o *opt.Options) (*DB, error) {
+	db, err := recoverDB(stor, o)
+	if err != nil {
+		return nil, err
+	}
+	if db.recoveryReport, err = db.checkValues(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func recoverDB(stor storage.Storage, o *opt.Options) (db *DB, err error) {
+	s, err := newSession(stor, o)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			if s.vStore != nil {
+				s.vStore.Close()
+			}
+			s.close()
+			s.release()
+		}
+	}()
+
+	err = recoverTable(s, o)
+	if err != nil {
+		return
+	}
+	s.vStore, err = openStore(valueStorage(stor, o), o, true)
+	if err != nil {
+		return
+	}
+	db, err = openDB(s)
+	if err != nil {
+		return
+	}
+	s.vStore.SetKeyStore(db)
+	return
+}
 
-//func Recover(stor storage.vStorage, o *opt.Options) (db *DB, err error) {
-//	s, err := newSession(stor, o)
-//	if err != nil {
-//		return
-//	}
-//	defer func() {
-//		if err != nil {
-//			s.close()
-//			s.release()
-//		}
-//	}()
+// RecoveryReport returns the keys found by Recover to point at missing or
+// truncated value log records. It returns nil if the DB was not opened by
+// Recover or RecoverFile.
 //
-//	err = recoverTable(s, o)
-//	if err != nil {
-//		return
-//	}
-//	return openDB(s)
-//}
+// The caller should not modify the contents of the returned report.
+func (db *DB) RecoveryReport() *ValueLogReport {
+	return db.recoveryReport
+}
 
 // RecoverFile recovers and opens a DB with missing or corrupted manifest files
 // for the given path. It will ignore any manifest files, valid or not.
@@ -269,25 +369,38 @@ func OpenFile(path string, o *opt.Options) (db *DB, err error) {
 // Also, Recover will ignore ErrorIfMissing and ErrorIfExist options.
 //
 // RecoverFile uses standard file-system backed storage implementation as described
-// in the leveldb/storage package.
+// in the leveldb/storage package, laid out as by OpenFile.
 //
 // The returned DB instance is safe for concurrent use.
 // The DB must be closed after use, by calling Close method.
-
-
-//func RecoverFile(path string, o *opt.Options) (db *DB, err error) {
-//	stor, err := storage.OpenFile(path, false)
-//	if err != nil {
-//		return
-//	}
-//	db, err = Recover(stor, o)
-//	if err != nil {
-//		stor.Close()
-//	} else {
-//		db.closer = stor
-//	}
-//	return
-//}
+func RecoverFile(path string, o *opt.Options) (db *DB, err error) {
+	stor, err := storage.OpenFile(pathpkg.Join(path, "key"), false)
+	if err != nil {
+		return
+	}
+	o, vStor, legacyPath, err := openValueStorage(path, o, false)
+	if err != nil {
+		stor.Close()
+		return
+	}
+	db, err = Recover(stor, o)
+	if err != nil {
+		if vStor != nil {
+			vStor.Close()
+		}
+		stor.Close()
+		return
+	}
+	db.s.vStore.closer = vStor
+	db.closer = stor
+	if legacyPath != "" {
+		if err = db.migrateLegacyValues(legacyPath); err != nil {
+			db.Close()
+			db = nil
+		}
+	}
+	return
+}
 
 func recoverTable(s *session, o *opt.Options) error {
 	o = dupOptions(o)
@@ -485,6 +598,33 @@ func recoverTable(s *session, o *opt.Options) error {
 	return s.commit(rec, false)
 }
 
+// checkValues reports the keys whose values point at missing or truncated
+// value log records. Unlike VerifyValueLog it does not read the records.
+func (db *DB) checkValues() (*ValueLogReport, error) {
+	report := &ValueLogReport{}
+	se := db.acquireSnapshot()
+	iter := db.newIterator(nil, nil, se.seq, se, nil, nil)
+	defer iter.Release()
+	for iter.Next() {
+		report.Keys++
+		v := iter.location
+		if len(v) > 0 && v[0] == valueTagInline {
+			continue
+		}
+		report.Separated++
+		if err := db.s.vStore.checkLocation(v); err != nil {
+			key := append([]byte{}, iter.Key()...)
+			db.logf("db@recovery dangling value %q: %v", key, err)
+			report.Problems = append(report.Problems, ValueLogProblem{Key: key, Err: err})
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	db.logf("db@recovery checked values N·%d dangling·%d", report.Keys, len(report.Problems))
+	return report, nil
+}
+
 func (db *DB) recoverJournal() error {
 	// Get all journals and sort it by file number.
 	rawFds, err := db.s.stor.List(storage.TypeJournal)
@@ -857,7 +997,10 @@ func (db *DB) Get(key []byte, ro *opt.ReadOptions) (value []byte, err error) {
 	se := db.acquireSnapshot()
 	defer db.releaseSnapshot(se)
 	location, err := db.get(nil, nil, key, se.seq, ro)
-	return db.s.vStore.Get(location), err
+	if err != nil {
+		return
+	}
+	return db.s.vStore.Resolve(location)
 }
 
 // Has returns true if the DB does contains the given key.
@@ -899,11 +1042,12 @@ func (db *DB) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterator.Itera
 		return iterator.NewEmptyIterator(err)
 	}
 
+	// Iterator holds 'version' lock, 'version' is immutable so tables are
+	// safe. The value files however are not versioned, the iterator holds
+	// the snapshot until released so that the value files it may read from
+	// are kept.
 	se := db.acquireSnapshot()
-	defer db.releaseSnapshot(se)
-	// Iterator holds 'version' lock, 'version' is immutable so snapshot
-	// can be released after iterator created.
-	return db.newIterator(nil, nil, se.seq, slice, ro)
+	return db.newIterator(nil, nil, se.seq, se, slice, ro)
 }
 
 // GetSnapshot returns a latest snapshot of the underlying DB. A snapshot
@@ -942,6 +1086,8 @@ func (db *DB) GetSnapshot() (*Snapshot, error) {
 //		Returns number of alive snapshots.
 //	leveldb.aliveiters
 //		Returns number of alive iterators.
+//	leveldb.valuelog
+//		Returns statistics of the value log.
 func (db *DB) GetProperty(name string) (value string, err error) {
 	err = db.ok()
 	if err != nil {
@@ -1024,6 +1170,32 @@ func (db *DB) GetProperty(name string) (value string, err error) {
 		value = fmt.Sprintf("%d", atomic.LoadInt32(&db.aliveSnaps))
 	case p == "aliveiters":
 		value = fmt.Sprintf("%d", atomic.LoadInt32(&db.aliveIters))
+	case p == "valuelog":
+		vs := db.s.vStore
+		value = "Value log\n" +
+			" Level |   Files    |    Size(MB)   |    Dead(MB)\n" +
+			"-------+------------+---------------+---------------\n"
+		var totalFiles int
+		var totalSize, totalDead int64
+		for level, ls := range vs.levelStats() {
+			if ls.Files == 0 {
+				continue
+			}
+			totalFiles += ls.Files
+			totalSize += ls.Size
+			totalDead += ls.Dead
+			value += fmt.Sprintf(" %3d   | %10d | %13.5f | %13.5f\n",
+				level, ls.Files, float64(ls.Size)/1048576.0, float64(ls.Dead)/1048576.0)
+		}
+		value += "-------+------------+---------------+---------------\n"
+		value += fmt.Sprintf(" Total | %10d | %13.5f | %13.5f\n",
+			totalFiles, float64(totalSize)/1048576.0, float64(totalDead)/1048576.0)
+		value += fmt.Sprintf("GCRuns:%d GCTime(sec):%.5f Relocated(MB):%.5f Reclaimed(MB):%.5f\n",
+			atomic.LoadUint32(&vs.gcRuns), time.Duration(atomic.LoadInt64(&vs.gcDuration)).Seconds(),
+			float64(atomic.LoadInt64(&vs.gcRelocated))/1048576.0, float64(atomic.LoadInt64(&vs.gcReclaimed))/1048576.0)
+		value += fmt.Sprintf("Read(MB):%.5f Write(MB):%.5f",
+			float64(atomic.LoadUint64(&vs.ioRead))/1048576.0,
+			float64(atomic.LoadUint64(&vs.ioWrite))/1048576.0)
 	default:
 		err = ErrNotFound
 	}
@@ -1046,6 +1218,20 @@ type DBStats struct {
 	BlockCacheSize    int
 	OpenedTablesCount int
 
+	ValueCacheSize   int
+	ValueCacheHits   uint64
+	ValueCacheMisses uint64
+
+	ValueLogSize        int64
+	ValueLogLiveSize    int64
+	ValueLogLevelFiles  []int
+	ValueLogGCRuns      uint32
+	ValueLogGCRelocated int64
+	ValueLogGCReclaimed int64
+	ValueLogGCDuration  time.Duration
+	ValueLogIORead      uint64
+	ValueLogIOWrite     uint64
+
 	LevelSizes        Sizes
 	LevelTablesCounts []int
 	LevelRead         Sizes
@@ -1077,6 +1263,27 @@ func (db *DB) Stats(s *DBStats) error {
 	} else {
 		s.BlockCacheSize = 0
 	}
+	if vcache := db.s.vStore.vcache; vcache != nil {
+		s.ValueCacheSize = vcache.Size()
+	} else {
+		s.ValueCacheSize = 0
+	}
+	s.ValueCacheHits = atomic.LoadUint64(&db.s.vStore.vcacheHit)
+	s.ValueCacheMisses = atomic.LoadUint64(&db.s.vStore.vcacheMiss)
+
+	vs := db.s.vStore
+	s.ValueLogSize = atomic.LoadInt64(&vs.Size)
+	s.ValueLogLiveSize = s.ValueLogSize - atomic.LoadInt64(&vs.Dead)
+	s.ValueLogLevelFiles = s.ValueLogLevelFiles[:0]
+	for _, ls := range vs.levelStats() {
+		s.ValueLogLevelFiles = append(s.ValueLogLevelFiles, ls.Files)
+	}
+	s.ValueLogGCRuns = atomic.LoadUint32(&vs.gcRuns)
+	s.ValueLogGCRelocated = atomic.LoadInt64(&vs.gcRelocated)
+	s.ValueLogGCReclaimed = atomic.LoadInt64(&vs.gcReclaimed)
+	s.ValueLogGCDuration = time.Duration(atomic.LoadInt64(&vs.gcDuration))
+	s.ValueLogIORead = atomic.LoadUint64(&vs.ioRead)
+	s.ValueLogIOWrite = atomic.LoadUint64(&vs.ioWrite)
 
 	s.AliveIterators = atomic.LoadInt32(&db.aliveIters)
 	s.AliveSnapshots = atomic.LoadInt32(&db.aliveSnaps)
@@ -1142,6 +1349,123 @@ func (db *DB) SizeOf(ranges []util.Range) (Sizes, error) {
 	return sizes, nil
 }
 
+// ValueLogProblem describes a key whose value cannot be read back from the
+// value log.
+type ValueLogProblem struct {
+	Key []byte
+	Err error
+}
+
+// ValueLogReport is the result of DB.VerifyValueLog, and of the value check
+// of Recover, see DB.RecoveryReport.
+type ValueLogReport struct {
+	// Keys is the number of live keys checked, Separated the number of
+	// those whose value is kept in the value log.
+	Keys, Separated int
+
+	// Problems lists the keys pointing at missing, truncated or mismatched
+	// value log records.
+	Problems []ValueLogProblem
+
+	// Repaired is the number of broken keys deleted.
+	Repaired int
+}
+
+// VerifyValueLog checks that the value of every live key can be read from
+// the value log, and that the value log record it points at holds the same
+// key, length and sequence number as the pointer.
+//
+// If repair is true the broken keys are deleted, unless they are written
+// to concurrently. Otherwise the DB is left untouched.
+func (db *DB) VerifyValueLog(repair bool) (*ValueLogReport, error) {
+	if err := db.ok(); err != nil {
+		return nil, err
+	}
+
+	report := &ValueLogReport{}
+	var rels []relocation
+	se := db.acquireSnapshot()
+	iter := db.newIterator(nil, nil, se.seq, se, nil, nil)
+	for iter.Next() {
+		report.Keys++
+		v := iter.location
+		if len(v) > 0 && v[0] == valueTagInline {
+			continue
+		}
+		report.Separated++
+		key := append([]byte{}, iter.Key()...)
+		if err := db.s.vStore.verifyRecord(key, v); err != nil {
+			if !errors.IsCorrupted(err) {
+				iter.Release()
+				return nil, err
+			}
+			report.Problems = append(report.Problems, ValueLogProblem{Key: key, Err: err})
+			rels = append(rels, relocation{key: key, from: append([]byte{}, v...)})
+		}
+	}
+	err := iter.Error()
+	iter.Release()
+	if err != nil {
+		return nil, err
+	}
+
+	if repair && len(rels) > 0 {
+		n, err := db.relocateRecs(rels, !db.s.o.GetNoSync())
+		if err != nil {
+			return nil, err
+		}
+		report.Repaired = n
+		db.logf("db@verify deleted N·%d broken keys", n)
+	}
+	return report, nil
+}
+
+// CompactValueLog compacts every value file that holds overwritten or
+// deleted values, moving the values still in use into fresh value files.
+// It waits for a running background compaction to finish first, and runs
+// even if background compaction is paused.
+//
+// The values in use are found by scanning the keys first, so the values
+// whose accounting was lost, e.g. along with the value log manifest or by
+// a failed write, are compacted as well.
+//
+// If ctx is done before the compaction completes, CompactValueLog stops
+// and returns ctx.Err(); the value files compacted so far stay compacted.
+func (db *DB) CompactValueLog(ctx context.Context) error {
+	if err := db.ok(); err != nil {
+		return err
+	}
+	// Stop on Close as well.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-db.closeC:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if err := db.s.vStore.compactAll(ctx); err != nil {
+		if db.isClosed() {
+			return ErrClosed
+		}
+		return err
+	}
+	return nil
+}
+
+// PauseValueLogGC pauses the background value log garbage collection. A
+// running collection stops once done with the value file at hand.
+func (db *DB) PauseValueLogGC() {
+	db.s.vStore.setPaused(true)
+}
+
+// ResumeValueLogGC resumes the background value log garbage collection,
+// see PauseValueLogGC.
+func (db *DB) ResumeValueLogGC() {
+	db.s.vStore.setPaused(false)
+}
+
 // Close closes the DB. This will also releases any outstanding snapshot,
 // abort any in-flight compaction and discard open transaction.
 //
@@ -1149,8 +1473,12 @@ func (db *DB) SizeOf(ranges []util.Range) (Sizes, error) {
 // It is valid to call Close multiple times. Other methods should not be
 // called after the DB has been closed.
 func (db *DB) Close() error {
-	db.s.vStore.Close()
-	if !db.setClosed() {
+	// Goroutines tracked by closeW are only started under the read lock,
+	// after checking the closed flag.
+	db.closeMu.Lock()
+	ok := db.setClosed()
+	db.closeMu.Unlock()
+	if !ok {
 		return ErrClosed
 	}
 
@@ -1184,6 +1512,9 @@ func (db *DB) Close() error {
 	// Wait for all gorotines to exit.
 	db.closeW.Wait()
 
+	// Persist the value log state, once value log compaction stopped.
+	vErr := db.s.vStore.Close()
+
 	// Closes journal.
 	if db.journal != nil {
 		db.journal.Close()
@@ -1208,6 +1539,10 @@ func (db *DB) Close() error {
 		db.closer = nil
 	}
 
+	if err == nil {
+		err = vErr
+	}
+
 	// Clear memdbs.
 	db.clearMems()
 
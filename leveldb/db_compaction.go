@@ -302,6 +302,13 @@ func (db *DB) memCompaction() {
 	// Generate tables.
 	db.compactionTransactFunc("memdb@flush", func(cnt *compactionTransactCounter) (err error) {
 		stats.startTimer()
+		// Tables must not refer to values that are not on disk yet.
+		if !db.s.o.GetNoSync() {
+			if err = db.s.vStore.Sync(); err != nil {
+				stats.stopTimer()
+				return
+			}
+		}
 		flushLevel, err = db.s.flushMemdb(rec, mdb.DB, db.memdbMaxLevel)
 		stats.stopTimer()
 		return
@@ -362,9 +369,11 @@ type tableCompactionBuilder struct {
 	snapIter        int
 	snapKerrCnt     int
 	snapDropCnt     int
+	snapDeadLen     int
 
 	kerrCnt int
 	dropCnt int
+	dead    [][]byte // Value log locations of the dropped values.
 
 	minSeq    uint64
 	strict    bool
@@ -429,6 +438,7 @@ func (b *tableCompactionBuilder) run(cnt *compactionTransactCounter) error {
 	lastSeq := b.snapLastSeq
 	b.kerrCnt = b.snapKerrCnt
 	b.dropCnt = b.snapDropCnt
+	b.dead = b.dead[:b.snapDeadLen]
 	// Restore compaction state.
 	b.c.restore()
 
@@ -477,6 +487,7 @@ func (b *tableCompactionBuilder) run(cnt *compactionTransactCounter) error {
 					b.snapIter = i
 					b.snapKerrCnt = b.kerrCnt
 					b.snapDropCnt = b.dropCnt
+					b.snapDeadLen = len(b.dead)
 				}
 
 				hasLastUkey = true
@@ -487,6 +498,9 @@ func (b *tableCompactionBuilder) run(cnt *compactionTransactCounter) error {
 			switch {
 			case lastSeq <= b.minSeq:
 				// Dropped because newer entry for same user key exist
+				if v := iter.Value(); kt == keyTypeVal && isValuePointer(v) {
+					b.dead = append(b.dead, append([]byte{}, v...))
+				}
 				fallthrough // (A)
 			case kt == keyTypeDel && seq <= b.minSeq && b.c.baseLevelForKey(lastUkey):
 				// For this user key:
@@ -584,6 +598,11 @@ func (db *DB) tableCompaction(c *compaction, noTrivial bool) {
 	db.compactionCommit("table", rec)
 	stats[1].stopTimer()
 
+	// The values of the dropped entries can no longer be reached.
+	if err := db.s.vStore.markDead(b.dead); err != nil {
+		db.logf("table@compaction value log accounting error %q", err)
+	}
+
 	resultSize := int(stats[1].write)
 	db.logf("table@compaction committed F%s S%s Ke·%d D·%d T·%v", sint(len(rec.addedTables)-len(rec.deletedTables)), sshortenb(resultSize-sourceSize), b.kerrCnt, b.dropCnt, stats[1].duration)
 
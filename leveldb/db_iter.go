@@ -7,6 +7,7 @@
 package leveldb
 
 import (
+	"bytes"
 	"errors"
 	"math/rand"
 	"runtime"
@@ -65,7 +66,10 @@ func (db *DB) newRawIterator(auxm *memDB, auxt tFiles, slice *util.Range, ro *op
 	return mi
 }
 
-func (db *DB) newIterator(auxm *memDB, auxt tFiles, seq uint64, slice *util.Range, ro *opt.ReadOptions) *dbIter {
+// newIterator returns a DB iterator at the given sequence. The iterator takes
+// over the snapshot element reference, which is held until the iterator is
+// released so that the value files are not removed under it.
+func (db *DB) newIterator(auxm *memDB, auxt tFiles, seq uint64, se *snapshotElement, slice *util.Range, ro *opt.ReadOptions) *dbIter {
 	var islice *util.Range
 	if slice != nil {
 		islice = &util.Range{}
@@ -81,15 +85,39 @@ func (db *DB) newIterator(auxm *memDB, auxt tFiles, seq uint64, slice *util.Rang
 		db:              db,
 		icmp:            db.s.icmp,
 		iter:            rawIter,
+		vs:              db.s.vStore,
 		seq:             seq,
+		se:              se,
 		strict:          opt.GetStrict(db.s.o.Options, ro, opt.StrictReader),
 		disableSampling: db.s.o.GetDisableSeeksCompaction() || db.s.o.GetIteratorSamplingRate() <= 0,
 		key:             make([]byte, 0),
-		value:           make([]byte, 0),
+		location:        make([]byte, 0),
 	}
 	if !iter.disableSampling {
 		iter.samplingGap = db.iterSamplingRate()
 	}
+	if depth := ro.GetValuePrefetch(); depth > 0 {
+		if auxm != nil {
+			// Released along with the raw iterator of the prefetcher.
+			auxm.incref()
+		}
+		iter.prefetcher = &valuePrefetcher{
+			icmp:  db.s.icmp,
+			vs:    db.s.vStore,
+			depth: depth,
+			ahead: &dbIter{
+				db:              db,
+				icmp:            db.s.icmp,
+				iter:            db.newRawIterator(auxm, auxt, islice, ro),
+				vs:              db.s.vStore,
+				seq:             seq,
+				strict:          iter.strict,
+				disableSampling: true,
+				key:             make([]byte, 0),
+				location:        make([]byte, 0),
+			},
+		}
+	}
 	atomic.AddInt32(&db.aliveIters, 1)
 	runtime.SetFinalizer(iter, (*dbIter).Release)
 	return iter
@@ -114,14 +142,19 @@ type dbIter struct {
 	db              *DB
 	icmp            *iComparer
 	iter            iterator.Iterator
+	vs              *vStorage
 	seq             uint64
+	se              *snapshotElement // Keeps the value files reachable.
 	strict          bool
 	disableSampling bool
 
 	samplingGap int
 	dir         dir
 	key         []byte
-	value       []byte
+	location    []byte // Value log location of the current entry.
+	value       []byte // Value resolved from location, valid if resolved.
+	resolved    bool
+	prefetcher  *valuePrefetcher // Nil unless values are prefetched.
 	err         error
 	releaser    util.Releaser
 }
@@ -142,7 +175,9 @@ func (i *dbIter) sampleSeek() {
 func (i *dbIter) setErr(err error) {
 	i.err = err
 	i.key = nil
+	i.location = nil
 	i.value = nil
+	i.resolved = false
 }
 
 func (i *dbIter) iterErr() {
@@ -219,7 +254,7 @@ func (i *dbIter) next() bool {
 				case keyTypeVal:
 					if i.dir == dirSOI || i.icmp.uCompare(ukey, i.key) > 0 {
 						i.key = append(i.key[:0], ukey...)
-						i.value = append(i.value[:0], i.iter.Value()...)
+						i.setLocation(i.iter.Value())
 						i.dir = dirForward
 						return true
 					}
@@ -268,7 +303,7 @@ func (i *dbIter) prev() bool {
 					del = (kt == keyTypeDel)
 					if !del {
 						i.key = append(i.key[:0], ukey...)
-						i.value = append(i.value[:0], i.iter.Value()...)
+						i.setLocation(i.iter.Value())
 					}
 				}
 			} else if i.strict {
@@ -327,10 +362,34 @@ func (i *dbIter) Key() []byte {
 	return i.key
 }
 
+// setLocation records the value log location of the current entry, the
+// value itself is only read from the value log once Value is called.
+func (i *dbIter) setLocation(location []byte) {
+	i.location = append(i.location[:0], location...)
+	i.resolved = false
+}
+
 func (i *dbIter) Value() []byte {
 	if i.err != nil || i.dir <= dirEOI {
 		return nil
 	}
+	if !i.resolved {
+		var (
+			value []byte
+			err   error
+		)
+		if i.prefetcher != nil && i.dir == dirForward {
+			value, err = i.prefetcher.get(i.key, i.location)
+		} else {
+			value, err = i.vs.Resolve(i.location)
+		}
+		if err != nil {
+			i.setErr(err)
+			return nil
+		}
+		i.value = append(i.value[:0], value...)
+		i.resolved = true
+	}
 	return i.value
 }
 
@@ -346,9 +405,17 @@ func (i *dbIter) Release() {
 
 		i.dir = dirReleased
 		i.key = nil
+		i.location = nil
 		i.value = nil
+		i.resolved = false
 		i.iter.Release()
 		i.iter = nil
+		if i.prefetcher != nil {
+			i.prefetcher.release()
+			i.prefetcher = nil
+		}
+		i.db.releaseSnapshot(i.se)
+		i.se = nil
 		atomic.AddInt32(&i.db.aliveIters, -1)
 		i.db = nil
 	}
@@ -367,3 +434,82 @@ func (i *dbIter) SetReleaser(releaser util.Releaser) {
 func (i *dbIter) Error() error {
 	return i.err
 }
+
+// valuePrefetcher reads the values of the entries following the current
+// entry of a forward moving dbIter ahead of time. The entries are found by
+// a second iterator running ahead of the dbIter, see opt.ReadOptions.
+type valuePrefetcher struct {
+	icmp  *iComparer
+	vs    *vStorage
+	depth int
+	ahead *dbIter // Positioned at the entry following the queue.
+	valid bool    // Whether ahead is valid.
+	queue []*prefetchedValue
+	wg    sync.WaitGroup
+}
+
+// prefetchedValue is a value being read ahead, value and err are set once
+// done is closed.
+type prefetchedValue struct {
+	key, location []byte
+	value         []byte
+	err           error
+	done          chan struct{}
+}
+
+// get returns the value at the given location of the given key, which is
+// the current entry of the dbIter.
+func (p *valuePrefetcher) get(key, location []byte) ([]byte, error) {
+	// Drop the values of the entries passed over.
+	for len(p.queue) > 0 && p.icmp.uCompare(p.queue[0].key, key) < 0 {
+		p.queue = p.queue[1:]
+	}
+	if len(p.queue) == 0 || p.icmp.uCompare(p.queue[0].key, key) > 0 {
+		// The dbIter jumped, start over from its entry.
+		p.queue = p.queue[:0]
+		p.valid = p.ahead.Seek(key)
+		p.fill()
+	}
+	if len(p.queue) == 0 || !bytes.Equal(p.queue[0].location, location) {
+		return p.vs.Resolve(location)
+	}
+	pv := p.queue[0]
+	p.queue = p.queue[1:]
+	p.fill()
+	<-pv.done
+	return pv.value, pv.err
+}
+
+// fill starts reading the values of the following entries until depth
+// values are queued.
+func (p *valuePrefetcher) fill() {
+	for p.valid && len(p.queue) < p.depth {
+		pv := &prefetchedValue{
+			key:      append([]byte{}, p.ahead.key...),
+			location: append([]byte{}, p.ahead.location...),
+			done:     make(chan struct{}),
+		}
+		if isValuePointer(pv.location) {
+			p.wg.Add(1)
+			go func() {
+				defer p.wg.Done()
+				pv.value, pv.err = p.vs.Resolve(pv.location)
+				close(pv.done)
+			}()
+		} else {
+			pv.value, pv.err = p.vs.Resolve(pv.location)
+			close(pv.done)
+		}
+		p.queue = append(p.queue, pv)
+		p.valid = p.ahead.Next()
+	}
+}
+
+// release waits for the pending reads and releases the iterator running
+// ahead. It must be called before the snapshot of the dbIter is released.
+func (p *valuePrefetcher) release() {
+	p.wg.Wait()
+	p.queue = nil
+	p.ahead.iter.Release()
+	p.ahead.iter = nil
+}
@@ -45,18 +45,37 @@ func (db *DB) acquireSnapshot() *snapshotElement {
 	return se
 }
 
-// Releases given snapshot element.
-func (db *DB) releaseSnapshot(se *snapshotElement) {
+// Adds a reference to the given snapshot element.
+func (db *DB) refSnapshot(se *snapshotElement) {
 	db.snapsMu.Lock()
 	defer db.snapsMu.Unlock()
 
+	if se.ref <= 0 {
+		panic("leveldb: Snapshot: element already released")
+	}
+	se.ref++
+}
+
+// Releases given snapshot element.
+func (db *DB) releaseSnapshot(se *snapshotElement) {
+	db.snapsMu.Lock()
 	se.ref--
+	var oldest bool
 	if se.ref == 0 {
+		oldest = db.snapsList.Front() == se.e
 		db.snapsList.Remove(se.e)
 		se.e = nil
 	} else if se.ref < 0 {
+		db.snapsMu.Unlock()
 		panic("leveldb: Snapshot: negative element reference")
 	}
+	db.snapsMu.Unlock()
+
+	// The minimum sequence advanced, value files retired in between are no
+	// longer reachable.
+	if oldest && db.s != nil {
+		db.s.vStore.releaseObsolete(db.minSeq())
+	}
 }
 
 // Gets minimum sequence that not being snapshotted.
@@ -97,6 +116,9 @@ func (snap *Snapshot) String() string {
 // Get gets the value for the given key. It returns ErrNotFound if
 // the DB does not contains the key.
 //
+// The value stays readable for as long as the snapshot is alive, value log
+// compaction keeps the value files a snapshot may still refer to.
+//
 // The caller should not modify the contents of the returned slice, but
 // it is safe to modify the contents of the argument after Get returns.
 func (snap *Snapshot) Get(key []byte, ro *opt.ReadOptions) (value []byte, err error) {
@@ -110,7 +132,11 @@ func (snap *Snapshot) Get(key []byte, ro *opt.ReadOptions) (value []byte, err er
 		err = ErrSnapshotReleased
 		return
 	}
-	return snap.db.get(nil, nil, key, snap.elem.seq, ro)
+	location, err := snap.db.get(nil, nil, key, snap.elem.seq, ro)
+	if err != nil {
+		return
+	}
+	return snap.db.s.vStore.Resolve(location)
 }
 
 // Has returns true if the DB does contains the given key.
@@ -160,9 +186,10 @@ func (snap *Snapshot) NewIterator(slice *util.Range, ro *opt.ReadOptions) iterat
 	if snap.released {
 		return iterator.NewEmptyIterator(ErrSnapshotReleased)
 	}
-	// Since iterator already hold version ref, it doesn't need to
-	// hold snapshot ref.
-	return snap.db.newIterator(nil, nil, snap.elem.seq, slice, ro)
+	// Iterator already hold version ref, the snapshot ref keeps the value
+	// files.
+	snap.db.refSnapshot(snap.elem)
+	return snap.db.newIterator(nil, nil, snap.elem.seq, snap.elem, slice, ro)
 }
 
 // Release releases the snapshot. This will not release any returned
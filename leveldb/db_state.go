@@ -230,6 +230,23 @@ func (db *DB) isClosed() bool {
 	return atomic.LoadUint32(&db.closed) != 0
 }
 
+// Run f in a goroutine tracked by closeW; return false if DB was closed.
+func (db *DB) goTracked(f func()) bool {
+	// Close waits for closeW once the closed flag is set, which it sets
+	// under closeMu.
+	db.closeMu.RLock()
+	defer db.closeMu.RUnlock()
+	if db.isClosed() {
+		return false
+	}
+	db.closeW.Add(1)
+	go func() {
+		defer db.closeW.Done()
+		f()
+	}()
+	return true
+}
+
 // Check read ok status.
 func (db *DB) ok() error {
 	if db.isClosed() {
@@ -9,9 +9,12 @@ package leveldb
 import (
 	"bytes"
 	"container/list"
+	"context"
 	crand "crypto/rand"
 	"encoding/binary"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -29,6 +32,7 @@ import (
 	"github.com/ccfarm/goleveldb/leveldb/errors"
 	"github.com/ccfarm/goleveldb/leveldb/filter"
 	"github.com/ccfarm/goleveldb/leveldb/iterator"
+	"github.com/ccfarm/goleveldb/leveldb/journal"
 	"github.com/ccfarm/goleveldb/leveldb/opt"
 	"github.com/ccfarm/goleveldb/leveldb/storage"
 	"github.com/ccfarm/goleveldb/leveldb/testutil"
@@ -270,6 +274,27 @@ func (h *dbHarness) getVal(key, value string) {
 	h.getValr(h.db, key, value)
 }
 
+// lsmValue returns the LSM value of the given key, that is either an inline
+// value or a value log location.
+func (h *dbHarness) lsmValue(key string) []byte {
+	t := h.t
+	db := h.db
+
+	se := db.acquireSnapshot()
+	defer db.releaseSnapshot(se)
+	v, err := db.get(nil, nil, []byte(key), se.seq, nil)
+	if err != nil {
+		t.Fatalf("get %q: got error: %v", key, err)
+	}
+	return v
+}
+
+func (h *dbHarness) separatedAssert(key string, want bool) {
+	if got := isValuePointer(h.lsmValue(key)); got != want {
+		h.t.Errorf("value of %q separated=%v, want %v", key, got, want)
+	}
+}
+
 func (h *dbHarness) allEntriesFor(key, want string) {
 	t := h.t
 	db := h.db
@@ -294,7 +319,12 @@ func (h *dbHarness) allEntriesFor(key, want string) {
 			first = false
 			switch kt {
 			case keyTypeVal:
-				res += string(iter.Value())
+				v, err := s.vStore.Resolve(iter.Value())
+				if err != nil {
+					res += "CORRUPTED"
+					break
+				}
+				res += string(v)
 			case keyTypeDel:
 				res += "DEL"
 			}
@@ -635,11 +665,12 @@ func TestDB_GetFromFrozen(t *testing.T) {
 	h.put("foo", "v1")
 	h.getVal("foo", "v1")
 
+	// Only the value locations take up the memtable, fill it until the
+	// memtable compaction is triggered.
 	h.stor.Stall(testutil.ModeSync, storage.TypeTable) // Block sync calls
-	h.put("k1", strings.Repeat("x", 100000))           // Fill memtable
-	h.put("k2", strings.Repeat("y", 100000))           // Trigger compaction
-	for i := 0; h.db.getFrozenMem() == nil && i < 100; i++ {
-		time.Sleep(10 * time.Microsecond)
+	n := 0
+	for ; h.db.getFrozenMem() == nil && n < 10000; n++ {
+		h.put(numKey(n), strings.Repeat("x", 1000))
 	}
 	if h.db.getFrozenMem() == nil {
 		h.stor.Release(testutil.ModeSync, storage.TypeTable)
@@ -650,8 +681,8 @@ func TestDB_GetFromFrozen(t *testing.T) {
 
 	h.reopenDB()
 	h.getVal("foo", "v1")
-	h.get("k1", true)
-	h.get("k2", true)
+	h.get(numKey(0), true)
+	h.get(numKey(n-1), true)
 }
 
 func TestDB_GetFromTable(t *testing.T) {
@@ -951,8 +982,9 @@ func TestDB_RecoverWithLargeJournal(t *testing.T) {
 	h.tablesPerLevel("")
 
 	// Make sure that if we re-open with a small write buffer size that
-	// we flush table files in the middle of a large journal file.
-	h.o.WriteBuffer = 100000
+	// we flush table files in the middle of a large journal file. Only
+	// the value locations count against the write buffer.
+	h.o.WriteBuffer = 64
 	h.reopenDB()
 	h.getVal("big1", strings.Repeat("1", 200000))
 	h.getVal("big2", strings.Repeat("2", 200000))
@@ -966,9 +998,13 @@ func TestDB_RecoverWithLargeJournal(t *testing.T) {
 }
 
 func TestDB_CompactionsGenerateMultipleFiles(t *testing.T) {
+	// The values are separated, so the tables hold only the keys and
+	// value locations and must be small to be split.
 	h := newDbHarnessWopt(t, &opt.Options{
 		DisableLargeBatchTransaction: true,
 		WriteBuffer:                  10000000,
+		BlockSize:                    256,
+		CompactionTableSize:          opt.KiB,
 		Compression:                  opt.NoCompression,
 	})
 	defer h.close()
@@ -1080,8 +1116,10 @@ func TestDB_SparseMerge(t *testing.T) {
 }
 
 func TestDB_SizeOf(t *testing.T) {
+	// The sizes are those of the tables, which must hold the values.
 	h := newDbHarnessWopt(t, &opt.Options{
 		DisableLargeBatchTransaction: true,
+		DisableValueSeparation:       true,
 		Compression:                  opt.NoCompression,
 		WriteBuffer:                  10000000,
 	})
@@ -1131,8 +1169,10 @@ func TestDB_SizeOf(t *testing.T) {
 }
 
 func TestDB_SizeOf_MixOfSmallAndLarge(t *testing.T) {
+	// The sizes are those of the tables, which must hold the values.
 	h := newDbHarnessWopt(t, &opt.Options{
 		DisableLargeBatchTransaction: true,
+		DisableValueSeparation:       true,
 		Compression:                  opt.NoCompression,
 	})
 	defer h.close()
@@ -1171,6 +1211,79 @@ func TestDB_SizeOf_MixOfSmallAndLarge(t *testing.T) {
 	}
 }
 
+func TestDB_SizeOf_Separated(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Compression:                  opt.NoCompression,
+		WriteBuffer:                  10000000,
+	})
+	defer h.close()
+
+	// Write 8MB (80 values, each 100K)
+	n := 80
+	for i := 0; i < n; i++ {
+		h.put(numKey(i), strings.Repeat(fmt.Sprintf("v%09d", i), 100000/10))
+	}
+
+	// 0 because SizeOf() does not account for memtable space
+	h.sizeAssert("", numKey(n), 0, 0)
+
+	// SizeOf() does not account for the value log either, only the keys
+	// and value locations are in the tables.
+	for r := 0; r < 3; r++ {
+		h.reopenDB()
+		h.sizeAssert("", numKey(n), 1, int64(100*n))
+		h.compactRangeAt(0, "", "")
+		h.sizeAssert("", numKey(n), 1, int64(100*n))
+	}
+}
+
+func TestDB_SizeOf_MixOfInlineAndSeparated(t *testing.T) {
+	const threshold = 50000
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Compression:                  opt.NoCompression,
+		ValueThreshold:               threshold,
+	})
+	defer h.close()
+
+	sizes := []int64{
+		10000,
+		10000,
+		100000,
+		10000,
+		100000,
+		10000,
+		300000,
+		10000,
+	}
+
+	for i, n := range sizes {
+		h.put(numKey(i), strings.Repeat(fmt.Sprintf("v%09d", i), int(n)/10))
+	}
+
+	for r := 0; r < 3; r++ {
+		h.reopenDB()
+
+		// Only the inline values add to the sizes.
+		var x int64
+		for i, n := range sizes {
+			y := x
+			if i > 0 {
+				y += 1000
+			}
+			h.sizeAssert("", numKey(i), x, y)
+			if n < threshold {
+				x += n
+			}
+		}
+
+		h.sizeAssert(numKey(3), numKey(5), 10000, 11000)
+
+		h.compactRangeAt(0, "", "")
+	}
+}
+
 func TestDB_Snapshot(t *testing.T) {
 	trun(t, func(h *dbHarness) {
 		h.put("foo", "v1")
@@ -2698,10 +2811,13 @@ func testDB_IterTriggeredCompaction(t *testing.T, limitDiv int) {
 		n     = tSize / vSize
 	)
 
+	// The values are separated, so the iterator reads only the keys and
+	// value locations from the tables and must sample more often.
 	h := newDbHarnessWopt(t, &opt.Options{
 		DisableLargeBatchTransaction: true,
 		Compression:                  opt.NoCompression,
 		DisableBlockCache:            true,
+		IteratorSamplingRate:         opt.KiB,
 	})
 	defer h.close()
 
@@ -2814,6 +2930,32 @@ func TestDB_ReadOnly(t *testing.T) {
 	h.assertNumKeys(4)
 }
 
+func TestDB_ReadOnlyValueLog(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	value := strings.Repeat("v", 1000)
+	h.put("foo", value)
+	h.put("bar", "v2")
+	h.closeDB()
+
+	modes := []testutil.StorageMode{testutil.ModeCreate, testutil.ModeRemove, testutil.ModeRename, testutil.ModeWrite, testutil.ModeSync}
+	for _, mode := range modes {
+		for _, ft := range []storage.FileType{storage.TypeValue, storage.TypeValueManifest} {
+			h.stor.EmulateError(mode, ft, errors.New("read-only value log shouldn't writes"))
+		}
+	}
+
+	h.o.ReadOnly = true
+	h.openDB()
+	h.getVal("foo", value)
+	h.getVal("bar", "v2")
+	if err := h.db.CompactValueLog(context.Background()); err != ErrReadOnly {
+		t.Fatalf("CompactValueLog: unexpected error: %v", err)
+	}
+	h.closeDB()
+}
+
 func TestDB_BulkInsertDelete(t *testing.T) {
 	h := newDbHarnessWopt(t, &opt.Options{
 		DisableLargeBatchTransaction: true,
@@ -2924,3 +3066,2054 @@ func TestDB_GracefulClose(t *testing.T) {
 	iter.Release()
 	closeWait.Wait()
 }
+
+func TestDB_ValueStorage(t *testing.T) {
+	vstor := storage.NewMemStorage()
+	defer vstor.Close()
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		ValueStorage:                 vstor,
+	})
+	defer h.close()
+
+	value := strings.Repeat("v", 1000)
+	h.put("foo", value)
+	h.put("bar", "v2")
+	h.reopenDB()
+	h.getVal("foo", value)
+	h.getVal("bar", "v2")
+
+	if fds, err := h.stor.List(storage.TypeValue | storage.TypeValueManifest); err != nil || len(fds) != 0 {
+		t.Errorf("value log files in DB storage: %v %v", fds, err)
+	}
+	if fds, err := vstor.List(storage.TypeValue); err != nil || len(fds) == 0 {
+		t.Errorf("no value log files in value storage: %v", err)
+	}
+}
+
+func TestDB_DisableValueSeparation(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		DisableValueSeparation:       true,
+	})
+	defer h.close()
+
+	v1, v2 := strings.Repeat("1", 1000), strings.Repeat("2", 1000)
+	h.put("foo", v1)
+	var s DBStats
+	if err := h.db.Stats(&s); err != nil {
+		t.Fatal("Stats: got error: ", err)
+	}
+	if s.ValueLogSize != 0 {
+		t.Errorf("value separated, value log size=%d", s.ValueLogSize)
+	}
+
+	// Values separated before remain readable.
+	h.o.DisableValueSeparation = false
+	h.reopenDB()
+	h.put("bar", v2)
+	h.o.DisableValueSeparation = true
+	h.reopenDB()
+	h.getVal("foo", v1)
+	h.getVal("bar", v2)
+}
+
+func TestDB_ValueSeparationPolicy(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		ValueSeparation: &opt.PrefixSeparation{
+			Prefix: []byte("blob/"),
+			Match:  opt.ThresholdSeparation(0),
+		},
+	})
+	defer h.close()
+
+	valueLogSize := func() int64 {
+		var s DBStats
+		if err := h.db.Stats(&s); err != nil {
+			t.Fatal("Stats: got error: ", err)
+		}
+		return s.ValueLogSize
+	}
+
+	meta := strings.Repeat("m", 1000)
+	h.put("meta/foo", meta)
+	if n := valueLogSize(); n != 0 {
+		t.Errorf("metadata separated, value log size=%d", n)
+	}
+	h.put("blob/foo", "b")
+	if n := valueLogSize(); n == 0 {
+		t.Error("blob not separated")
+	}
+
+	h.reopenDB()
+	h.getVal("meta/foo", meta)
+	h.getVal("blob/foo", "b")
+}
+
+func TestDB_ValueLogBatchWrite(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	v1, v2 := strings.Repeat("1", 1000), strings.Repeat("2", 1000)
+	h.put("put", v1)
+	h.put("gone", v1)
+
+	b := new(Batch)
+	b.Put([]byte("batch"), []byte(v1))
+	b.Put([]byte("small"), []byte("s"))
+	b.Put([]byte("put"), []byte(v2))
+	b.Delete([]byte("gone"))
+	h.write(b)
+
+	// Batch-written values are stored like Put-written ones.
+	check := func() {
+		h.getVal("put", v2)
+		h.getVal("batch", v1)
+		h.getVal("small", "s")
+		h.get("gone", false)
+		h.separatedAssert("put", true)
+		h.separatedAssert("batch", true)
+		h.separatedAssert("small", false)
+	}
+	check()
+
+	tr, err := h.db.OpenTransaction()
+	if err != nil {
+		t.Fatal("OpenTransaction: got error: ", err)
+	}
+	b.Reset()
+	b.Put([]byte("tr"), []byte(v2))
+	if err := tr.Write(b, nil); err != nil {
+		t.Fatal("Transaction.Write: got error: ", err)
+	}
+	if err := tr.Commit(); err != nil {
+		t.Fatal("Commit: got error: ", err)
+	}
+	h.getVal("tr", v2)
+	h.separatedAssert("tr", true)
+
+	h.reopenDB()
+	check()
+	h.getVal("tr", v2)
+}
+
+func TestDB_ValueLogBatchWriteAtomic(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	value := strings.Repeat("v", 1000)
+	b := new(Batch)
+	b.Put([]byte("foo"), []byte(value))
+	b.Put([]byte("bar"), []byte(value))
+
+	// A batch whose journal write fails is not applied, although its values
+	// made it to the value log.
+	h.stor.EmulateErrorOnce(testutil.ModeWrite, storage.TypeJournal, errors.New("journal write error"))
+	if err := h.db.Write(b, nil); err == nil {
+		t.Fatal("Write: expect error")
+	}
+	h.closeDB()
+	h.openDB()
+	h.get("foo", false)
+	h.get("bar", false)
+
+	h.write(b)
+	h.getVal("foo", value)
+	h.getVal("bar", value)
+}
+
+func TestDB_ValueLogLargeValueMemdb(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		WriteBuffer:                  64 * opt.KiB,
+	})
+	defer h.close()
+
+	// Only the locations of the values take up memdb space, so values larger
+	// than the write buffer do not rotate the memdb, and its journal.
+	h.stor.ResetCounter(testutil.ModeCreate, storage.TypeJournal)
+	for i := 0; i < 10; i++ {
+		h.put(fmt.Sprintf("k%d", i), string(tval(i, 100*opt.KiB)))
+	}
+	if n, _ := h.stor.Counter(testutil.ModeCreate, storage.TypeJournal); n != 0 {
+		t.Errorf("memdb rotated %d times", n)
+	}
+	for i := 0; i < 10; i++ {
+		h.getVal(fmt.Sprintf("k%d", i), string(tval(i, 100*opt.KiB)))
+	}
+}
+
+func TestDB_ValueLogWriteMerge(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	const n = 8
+	wo := &opt.WriteOptions{Sync: true}
+	put := func(i int, errC chan<- error) {
+		errC <- h.db.Put([]byte(fmt.Sprintf("k%d", i)), tval(i, 1000), wo)
+	}
+
+	// Hold the first write in its journal write, so that the next writes
+	// queue up to be merged into a single group.
+	errC := make(chan error, n+1)
+	h.stor.ResetCounter(testutil.ModeSync, storage.TypeValue)
+	h.stor.Stall(testutil.ModeWrite, storage.TypeJournal)
+	go put(0, errC)
+	for i := 0; ; i++ {
+		if n, _ := h.stor.Counter(testutil.ModeSync, storage.TypeValue); n > 0 {
+			break
+		} else if i == 500 {
+			t.Fatal("first write not synced")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 1; i <= n; i++ {
+		go put(i, errC)
+	}
+	time.Sleep(100 * time.Millisecond)
+	h.stor.ResetCounter(testutil.ModeWrite, storage.TypeValue)
+	h.stor.ResetCounter(testutil.ModeSync, storage.TypeValue)
+	h.stor.Release(testutil.ModeWrite, storage.TypeJournal)
+	for i := 0; i <= n; i++ {
+		if err := <-errC; err != nil {
+			t.Error("Put: got error: ", err)
+		}
+	}
+
+	// The values of the group are appended and synced at once.
+	if writes, _ := h.stor.Counter(testutil.ModeWrite, storage.TypeValue); writes != 1 {
+		t.Errorf("value log writes: got %d, want 1", writes)
+	}
+	if syncs, _ := h.stor.Counter(testutil.ModeSync, storage.TypeValue); syncs > 1 {
+		t.Errorf("value log syncs: got %d, want at most 1", syncs)
+	}
+	for i := 0; i <= n; i++ {
+		h.getVal(fmt.Sprintf("k%d", i), string(tval(i, 1000)))
+	}
+}
+
+func TestDB_ValueLogIterator(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	for i := 0; i < 20; i++ {
+		h.put(numKey(i), strings.Repeat(numKey(i), 100))
+	}
+	h.put("small", "s")
+	h.compactMem()
+	for i := 0; i < 20; i += 2 {
+		h.put(numKey(i), strings.Repeat("x", 1000))
+	}
+
+	want := func(key string) string {
+		if key == "small" {
+			return "s"
+		}
+		var i int
+		fmt.Sscanf(key, "key%06d", &i)
+		if i%2 == 0 {
+			return strings.Repeat("x", 1000)
+		}
+		return key + strings.Repeat(key, 99)
+	}
+	check := func(name string, iter iterator.Iterator, n int) {
+		defer iter.Release()
+		got := 0
+		for iter.Next() {
+			got++
+			if v := string(iter.Value()); v != want(string(iter.Key())) {
+				t.Errorf("%s: invalid value of %q, got %d bytes", name, iter.Key(), len(v))
+			}
+		}
+		if iter.Last() && string(iter.Value()) != want(string(iter.Key())) {
+			t.Errorf("%s: invalid value of last key %q", name, iter.Key())
+		}
+		if iter.Seek([]byte(numKey(5))) && string(iter.Value()) != want(numKey(5)) {
+			t.Errorf("%s: invalid value after seek", name)
+		}
+		if iter.Prev() && string(iter.Value()) != want(numKey(4)) {
+			t.Errorf("%s: invalid value after prev", name)
+		}
+		if err := iter.Error(); err != nil {
+			t.Errorf("%s: got error: %v", name, err)
+		}
+		if got != n {
+			t.Errorf("%s: got %d keys, want %d", name, got, n)
+		}
+	}
+
+	check("DB", h.db.NewIterator(nil, nil), 21)
+	snap := h.getSnapshot()
+	check("Snapshot", snap.NewIterator(nil, nil), 21)
+	snap.Release()
+	tr, err := h.db.OpenTransaction()
+	if err != nil {
+		t.Fatal("OpenTransaction: got error: ", err)
+	}
+	tr.Put([]byte(numKey(20)), []byte(want(numKey(20))), nil)
+	check("Transaction", tr.NewIterator(nil, nil), 22)
+	tr.Discard()
+
+	// A value that can't be read is reported as iterator error.
+	iter := h.db.NewIterator(nil, nil)
+	defer iter.Release()
+	if !iter.First() {
+		t.Fatal("First: got no key")
+	}
+	iter.(*dbIter).setLocation(generateLocation(1000, 1000, 0, 0, 0))
+	if iter.Value() != nil {
+		t.Error("Value: got value of missing record")
+	}
+	if err := iter.Error(); !errors.IsCorrupted(err) {
+		t.Errorf("Error: got %v, want ErrCorrupted", err)
+	}
+}
+
+func TestDB_ValueLogSnapshotGet(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		ValueLogFileSize:             4 * opt.KiB,
+		ValueLogGCPaused:             true,
+	})
+	defer h.close()
+
+	v1 := func(i int) string { return string(tval(i, 1000)) }
+	v2 := func(i int) string { return string(tval(100+i, 1000)) }
+	for i := 0; i < 8; i++ {
+		h.put(fmt.Sprintf("a%d", i), v1(i))
+		h.put(fmt.Sprintf("b%d", i), v1(i))
+	}
+	// The old values of a* are dropped and become garbage.
+	for i := 0; i < 8; i++ {
+		h.put(fmt.Sprintf("a%d", i), v2(i))
+	}
+	h.compactMem()
+	h.compactRange("", "")
+
+	snap := h.getSnapshot()
+	tr, err := h.db.OpenTransaction()
+	if err != nil {
+		t.Fatal("OpenTransaction: got error: ", err)
+	}
+	h.getValr(tr, "a0", v2(0))
+	h.getValr(tr, "b0", v1(0))
+	tr.Discard()
+	for i := 0; i < 8; i++ {
+		h.put(fmt.Sprintf("b%d", i), v2(i))
+	}
+
+	if err := h.db.CompactValueLog(context.Background()); err != nil {
+		t.Fatal("CompactValueLog: got error: ", err)
+	}
+	retired := h.obsoleteFiles()
+	if len(retired) == 0 {
+		t.Fatal("no value file retired")
+	}
+
+	// The snapshot still reads the values of the retired files.
+	for i := 0; i < 8; i++ {
+		h.getValr(snap, fmt.Sprintf("a%d", i), v2(i))
+		h.getValr(snap, fmt.Sprintf("b%d", i), v1(i))
+		h.getVal(fmt.Sprintf("a%d", i), v2(i))
+		h.getVal(fmt.Sprintf("b%d", i), v2(i))
+	}
+	iter := snap.NewIterator(nil, nil)
+	n := 0
+	for iter.Next() {
+		want := v1(n % 8)
+		if n < 8 {
+			want = v2(n)
+		}
+		n++
+		if string(iter.Value()) != want {
+			t.Errorf("snapshot iterator: invalid value of %q", iter.Key())
+		}
+	}
+	if err := iter.Error(); err != nil {
+		t.Error("snapshot iterator: got error: ", err)
+	}
+	if n != 16 {
+		t.Errorf("snapshot iterator: got %d keys, want 16", n)
+	}
+
+	// Released along with the last reader, which does not wait for the
+	// files to be removed.
+	snap.Release()
+	if len(h.obsoleteFiles()) == 0 {
+		t.Error("value files removed under the iterator")
+	}
+	h.stor.Stall(testutil.ModeRemove, storage.TypeValue)
+	released := make(chan struct{})
+	go func() {
+		iter.Release()
+		close(released)
+	}()
+	select {
+	case <-released:
+	case <-time.After(5 * time.Second):
+		h.stor.Release(testutil.ModeRemove, storage.TypeValue)
+		t.Fatal("iterator release waited for the value files to be removed")
+	}
+	if n := len(h.obsoleteFiles()); n != 0 {
+		t.Errorf("%d value files left after the snapshot was released", n)
+	}
+	h.stor.Release(testutil.ModeRemove, storage.TypeValue)
+	for i := 0; ; i++ {
+		fds, err := h.stor.List(storage.TypeValue)
+		if err != nil {
+			t.Fatal("List: got error: ", err)
+		}
+		left := 0
+		for _, fd := range fds {
+			for _, f := range retired {
+				if fd == valueFileDesc(f.File.Level, f.File.Number) {
+					left++
+				}
+			}
+		}
+		if left == 0 {
+			break
+		}
+		if i == 500 {
+			t.Fatalf("%d retired value files not removed", left)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	h.reopenDB()
+	for i := 0; i < 8; i++ {
+		h.getVal(fmt.Sprintf("a%d", i), v2(i))
+		h.getVal(fmt.Sprintf("b%d", i), v2(i))
+	}
+}
+
+// obsoleteFiles returns the value files queued for removal.
+func (h *dbHarness) obsoleteFiles() []obsoleteFile {
+	vs := h.db.s.vStore
+	vs.Mutex.Lock()
+	defer vs.Mutex.Unlock()
+	return append([]obsoleteFile{}, vs.Obsolete...)
+}
+
+// lastValueFile returns the content of the last non-empty level-0 value file.
+func (h *dbHarness) lastValueFile() (storage.FileDesc, []byte) {
+	fds, err := h.stor.List(storage.TypeValue)
+	if err != nil {
+		h.t.Fatal("List: got error: ", err)
+	}
+	var (
+		last    storage.FileDesc
+		content []byte
+	)
+	for _, fd := range fds {
+		if level, num := parseValueFileDesc(fd); level != 0 || (content != nil && num < int(last.Num)) {
+			continue
+		}
+		r, err := h.stor.Open(fd)
+		if err != nil {
+			h.t.Fatal("Open: got error: ", err)
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			h.t.Fatal("ReadAll: got error: ", err)
+		}
+		if len(b) > 0 {
+			last, content = fd, b
+		}
+	}
+	if content == nil {
+		h.t.Fatal("no value file")
+	}
+	return last, content
+}
+
+func (h *dbHarness) writeFile(fd storage.FileDesc, content []byte) {
+	w, err := h.stor.Create(fd)
+	if err != nil {
+		h.t.Fatal("Create: got error: ", err)
+	}
+	if _, err := w.Write(content); err != nil {
+		h.t.Fatal("Write: got error: ", err)
+	}
+	if err := w.Close(); err != nil {
+		h.t.Fatal("Close: got error: ", err)
+	}
+}
+
+func TestDB_ValueLogRecoverTornTail(t *testing.T) {
+	for _, manifest := range []bool{true, false} {
+		t.Run(fmt.Sprintf("manifest=%v", manifest), func(t *testing.T) {
+			h := newDbHarnessWopt(t, &opt.Options{
+				DisableLargeBatchTransaction: true,
+				Compression:                  opt.NoCompression,
+			})
+			defer h.close()
+
+			for i := 0; i < 8; i++ {
+				h.put(fmt.Sprintf("k%d", i), string(tval(i, 1000)))
+			}
+			h.closeDB()
+
+			// Half of a record appended by an interrupted write.
+			fd, content := h.lastValueFile()
+			tail := append(content, content[:len(content)/16]...)
+			h.writeFile(fd, tail)
+			if !manifest {
+				fds, err := h.stor.List(storage.TypeValueManifest)
+				if err != nil {
+					t.Fatal("List: got error: ", err)
+				}
+				for _, fd := range fds {
+					if err := h.stor.Remove(fd); err != nil {
+						t.Fatal("Remove: got error: ", err)
+					}
+				}
+			}
+
+			h.openDB()
+			for i := 0; i < 8; i++ {
+				h.getVal(fmt.Sprintf("k%d", i), string(tval(i, 1000)))
+			}
+			var s DBStats
+			if err := h.db.Stats(&s); err != nil {
+				t.Fatal("Stats: got error: ", err)
+			}
+			if s.ValueLogSize != int64(len(content)) {
+				t.Errorf("value log size: got %d, want %d", s.ValueLogSize, len(content))
+			}
+
+			// New values go to a new file; the torn tail is never read.
+			h.put("k8", string(tval(8, 1000)))
+			h.reopenDB()
+			for i := 0; i < 9; i++ {
+				h.getVal(fmt.Sprintf("k%d", i), string(tval(i, 1000)))
+			}
+			h.closeDB()
+			if _, got := h.lastValueFile(); bytes.Contains(got, tail) {
+				t.Error("value appended after the torn tail")
+			}
+		})
+	}
+}
+
+func TestDB_ValueLogRecoverLostTail(t *testing.T) {
+	for _, manifest := range []bool{true, false} {
+		t.Run(fmt.Sprintf("manifest=%v", manifest), func(t *testing.T) {
+			h := newDbHarnessWopt(t, &opt.Options{
+				DisableLargeBatchTransaction: true,
+				Compression:                  opt.NoCompression,
+			})
+			defer h.close()
+
+			for i := 0; i < 8; i++ {
+				h.put(fmt.Sprintf("k%d", i), string(tval(i, 1000)))
+			}
+			h.closeDB()
+
+			// The journal made it to disk, but the value log lost its tail
+			// from the middle of the sixth record on.
+			fd, content := h.lastValueFile()
+			rl := len(content) / 8
+			h.writeFile(fd, content[:5*rl+rl/2])
+			if !manifest {
+				fds, err := h.stor.List(storage.TypeValueManifest)
+				if err != nil {
+					t.Fatal("List: got error: ", err)
+				}
+				for _, fd := range fds {
+					if err := h.stor.Remove(fd); err != nil {
+						t.Fatal("Remove: got error: ", err)
+					}
+				}
+			}
+
+			h.openDB()
+			for i := 0; i < 5; i++ {
+				h.getVal(fmt.Sprintf("k%d", i), string(tval(i, 1000)))
+			}
+			for i := 5; i < 8; i++ {
+				if _, err := h.db.Get([]byte(fmt.Sprintf("k%d", i)), h.ro); !errors.IsCorrupted(err) {
+					t.Errorf("Get k%d: got error %v, want ErrCorrupted", i, err)
+				}
+			}
+			var s DBStats
+			if err := h.db.Stats(&s); err != nil {
+				t.Fatal("Stats: got error: ", err)
+			}
+			if s.ValueLogSize != int64(5*rl) {
+				t.Errorf("value log size: got %d, want %d", s.ValueLogSize, 5*rl)
+			}
+			report, err := h.db.VerifyValueLog(false)
+			if err != nil {
+				t.Fatal("VerifyValueLog: got error: ", err)
+			}
+			if len(report.Problems) != 3 {
+				t.Errorf("VerifyValueLog: got %d problems, want 3", len(report.Problems))
+			}
+
+			// New values go to a new file past the lost tail.
+			h.put("k8", string(tval(8, 1000)))
+			h.reopenDB()
+			for i := 0; i < 5; i++ {
+				h.getVal(fmt.Sprintf("k%d", i), string(tval(i, 1000)))
+			}
+			h.getVal("k8", string(tval(8, 1000)))
+		})
+	}
+}
+
+func TestDB_ValueLogCorrupted(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Compression:                  opt.NoCompression,
+	})
+	defer h.close()
+
+	value := string(tval(0, 1000))
+	h.put("foo", value)
+	h.closeDB()
+
+	assertCorrupted := func(err error, fd storage.FileDesc, reason string) {
+		t.Helper()
+		cerr, ok := err.(*errors.ErrCorrupted)
+		if !ok {
+			t.Fatalf("got error %v, want ErrCorrupted", err)
+		}
+		if cerr.Fd != fd {
+			t.Errorf("corrupted file: got %v, want %v", cerr.Fd, fd)
+		}
+		verr, ok := cerr.Err.(*ErrValueCorrupted)
+		if !ok {
+			t.Fatalf("got error %v, want ErrValueCorrupted", cerr.Err)
+		}
+		if level, num := parseValueFileDesc(fd); verr.Level != level || verr.FileNumber != num {
+			t.Errorf("corrupted file: got level=%d file=%d, want level=%d file=%d", verr.Level, verr.FileNumber, level, num)
+		}
+		if verr.Reason != reason {
+			t.Errorf("corruption reason: got %q, want %q", verr.Reason, reason)
+		}
+	}
+
+	fd, content := h.lastValueFile()
+	content[len(content)-1] ^= 0xff
+	h.writeFile(fd, content)
+	h.openDB()
+	_, err := h.db.Get([]byte("foo"), h.ro)
+	assertCorrupted(err, fd, "checksum mismatch")
+	iter := h.db.NewIterator(nil, h.ro)
+	if !iter.First() {
+		t.Fatal("First: got no key")
+	}
+	if iter.Value() != nil {
+		t.Error("Value: got corrupted value")
+	}
+	assertCorrupted(iter.Error(), fd, "checksum mismatch")
+	iter.Release()
+
+	// A location past the end of the file is reported before the record
+	// is allocated, however long it claims to be.
+	_, fileNumber, offset, seq, level, ok := parseLocation(h.lsmValue("foo"))
+	if !ok {
+		t.Fatal("foo: got no location")
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = h.db.s.vStore.Get(generateLocation(math.MaxInt32, fileNumber, offset, seq, level))
+	runtime.ReadMemStats(&after)
+	assertCorrupted(err, fd, "truncated record")
+	if n := after.TotalAlloc - before.TotalAlloc; n > 64*opt.MiB {
+		t.Errorf("Get: allocated %d bytes for a corrupted location", n)
+	}
+	h.closeDB()
+
+	if err := h.stor.Remove(fd); err != nil {
+		t.Fatal("Remove: got error: ", err)
+	}
+	h.openDB()
+	_, err = h.db.Get([]byte("foo"), h.ro)
+	assertCorrupted(err, fd, "missing value file")
+}
+
+func TestDB_ValueLogRelocateStale(t *testing.T) {
+	h := newDbHarness(t)
+	defer h.close()
+
+	h.put("foo", strings.Repeat("1", 1000))
+	from := h.lsmValue("foo")
+	h.put("bar", strings.Repeat("2", 1000))
+	to := h.lsmValue("bar")
+
+	// The key was overwritten since the record was read, the relocation
+	// must not resurrect the old value.
+	h.put("foo", strings.Repeat("3", 1000))
+	rels := []relocation{{key: []byte("foo"), from: from, to: to}}
+	if n, err := h.db.relocateRecs(rels, false); err != nil || n != 0 || rels[0].applied {
+		t.Fatalf("relocateRecs: got n=%d applied=%v err=%v, want nothing applied", n, rels[0].applied, err)
+	}
+	h.getVal("foo", strings.Repeat("3", 1000))
+
+	// Neither a deleted one.
+	from = h.lsmValue("foo")
+	h.delete("foo")
+	rels = []relocation{{key: []byte("foo"), from: from, to: to}}
+	if n, err := h.db.relocateRecs(rels, false); err != nil || n != 0 {
+		t.Fatalf("relocateRecs: got n=%d err=%v, want nothing applied", n, err)
+	}
+	h.get("foo", false)
+}
+
+func TestDB_ValueLogConcurrentCompaction(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Compression:                  opt.NoCompression,
+		ValueLogFileSize:             16 * opt.KiB,
+		WriteBuffer:                  64 * opt.KiB,
+		ValueLogGCPaused:             true,
+	})
+	defer h.close()
+
+	const (
+		writers = 4
+		keys    = 16
+		rounds  = 50
+	)
+	value := func(w, k, r int) string {
+		return fmt.Sprintf("%d-%d-%d-%s", w, k, r, tval(w*keys+k, 200))
+	}
+
+	var (
+		wg   sync.WaitGroup
+		done = make(chan struct{})
+	)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				for k := 0; k < keys; k++ {
+					key := []byte(fmt.Sprintf("w%d-k%02d", w, k))
+					if err := h.db.Put(key, []byte(value(w, k, r)), nil); err != nil {
+						t.Errorf("Put: got error: %v", err)
+						return
+					}
+					v, err := h.db.Get(key, nil)
+					if err != nil {
+						t.Errorf("Get: got error: %v", err)
+						return
+					}
+					if string(v) != value(w, k, r) {
+						t.Errorf("Get %q: got stale value %q", key, v[:16])
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	gcDone := make(chan struct{})
+	go func() {
+		defer close(gcDone)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := h.db.CompactRange(util.Range{}); err != nil {
+				t.Errorf("CompactRange: got error: %v", err)
+				return
+			}
+			if err := h.db.CompactValueLog(context.Background()); err != nil {
+				t.Errorf("CompactValueLog: got error: %v", err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(done)
+	<-gcDone
+
+	check := func() {
+		for w := 0; w < writers; w++ {
+			for k := 0; k < keys; k++ {
+				h.getVal(fmt.Sprintf("w%d-k%02d", w, k), value(w, k, rounds-1))
+			}
+		}
+	}
+	check()
+	if err := h.db.CompactValueLog(context.Background()); err != nil {
+		t.Fatal("CompactValueLog: got error: ", err)
+	}
+	check()
+	h.reopenDB()
+	check()
+}
+
+func TestDB_ValueThreshold(t *testing.T) {
+	for _, test := range []struct {
+		threshold int
+		size      int
+		separated bool
+	}{
+		{0, 0, false},
+		{0, 63, false},
+		{0, 64, true},
+		{0, 1000, true},
+		{10, 9, false},
+		{10, 10, true},
+		{-1, 0, true},
+		{-1, 1, true},
+	} {
+		t.Run(fmt.Sprintf("threshold=%d,size=%d", test.threshold, test.size), func(t *testing.T) {
+			h := newDbHarnessWopt(t, &opt.Options{
+				DisableLargeBatchTransaction: true,
+				ValueThreshold:               test.threshold,
+			})
+			defer h.close()
+
+			value := strings.Repeat("v", test.size)
+			h.put("foo", value)
+			h.separatedAssert("foo", test.separated)
+			h.getVal("foo", value)
+
+			// Still in place after the memdb is flushed and the DB reopened.
+			h.compactMem()
+			h.reopenDB()
+			h.separatedAssert("foo", test.separated)
+			h.getVal("foo", value)
+		})
+	}
+
+	// A key too long for a value log record keeps its value inline.
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		ValueThreshold:               -1,
+	})
+	defer h.close()
+	key := strings.Repeat("k", vRecordMaxKeyLen+1)
+	h.put(key, "v")
+	h.separatedAssert(key, false)
+	h.getVal(key, "v")
+}
+
+// writeLegacyDB creates a DB at the given path laid out as written before
+// values were tagged, and returns its content.
+func writeLegacyDB(t *testing.T, dbpath string, manifest bool) map[string]string {
+	db, err := OpenFile(dbpath, nil)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	kvs := make(map[string]string)
+	var (
+		records []byte
+		batch   = new(Batch)
+	)
+	for i := 0; i < 16; i++ {
+		key, value := fmt.Sprintf("k%02d", i), string(tval(i, 100+i))
+		kvs[key] = value
+		record := make([]byte, legacyRecordHeaderLen, legacyRecordHeaderLen+len(key)+len(value))
+		binary.BigEndian.PutUint32(record[0:], uint32(legacyRecordHeaderLen+len(key)+len(value)))
+		binary.BigEndian.PutUint32(record[4:], uint32(len(key)))
+		binary.BigEndian.PutUint32(record[8:], uint32(len(value)))
+		binary.BigEndian.PutUint32(record[12:], uint32(i))
+		record = append(append(record, key...), value...)
+		location := make([]byte, legacyLocationLen)
+		binary.BigEndian.PutUint32(location[0:], uint32(len(record)))
+		binary.BigEndian.PutUint32(location[8:], uint32(len(records)))
+		binary.BigEndian.PutUint32(location[12:], uint32(i))
+		batch.Put([]byte(key), location)
+		records = append(records, record...)
+	}
+	// Written as is, bypassing value separation.
+	db.writeLockC <- struct{}{}
+	if err := db.writeLocked(batch, batch, false, true, false); err != nil {
+		t.Fatal("write: got error: ", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal("Close: got error: ", err)
+	}
+
+	valuePath := filepath.Join(dbpath, "value")
+	if err := os.RemoveAll(valuePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(valuePath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(valuePath, "level_0_number_0.value"), records, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if manifest {
+		if err := ioutil.WriteFile(filepath.Join(valuePath, Manifest), make([]byte, ManifestSize), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return kvs
+}
+
+func TestDB_MigrateLegacyValues(t *testing.T) {
+	for _, manifest := range []bool{true, false} {
+		t.Run(fmt.Sprintf("manifest=%v", manifest), func(t *testing.T) {
+			dbpath, err := ioutil.TempDir("", "goleveldbtestMigrateLegacyValues")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dbpath)
+			kvs := writeLegacyDB(t, dbpath, manifest)
+
+			if _, err := OpenFile(dbpath, &opt.Options{ReadOnly: true}); err != ErrReadOnly {
+				t.Fatalf("OpenFile read-only: got error %v, want ErrReadOnly", err)
+			}
+			for i := 0; i < 2; i++ {
+				db, err := OpenFile(dbpath, nil)
+				if err != nil {
+					t.Fatal("OpenFile: got error: ", err)
+				}
+				for key, value := range kvs {
+					if v, err := db.Get([]byte(key), nil); err != nil || string(v) != value {
+						t.Errorf("Get %q: got %q, %v", key, v, err)
+					}
+				}
+				if err := db.Close(); err != nil {
+					t.Fatal("Close: got error: ", err)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(dbpath, "value"+legacySuffix)); !os.IsNotExist(err) {
+				t.Errorf("legacy value log left: %v", err)
+			}
+		})
+	}
+}
+
+func TestDB_LegacyValuesDetection(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "goleveldbtestLegacyValuesDetection")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	// A value log whose manifest is lost is told by its records.
+	db, err := OpenFile(dbpath, nil)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	value := string(tval(0, 1000))
+	if err := db.Put([]byte("foo"), []byte(value), nil); err != nil {
+		t.Fatal("Put: got error: ", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal("Close: got error: ", err)
+	}
+	valuePath := filepath.Join(dbpath, "value")
+	manifests, err := filepath.Glob(filepath.Join(valuePath, "VMANIFEST-*"))
+	if err != nil || len(manifests) == 0 {
+		t.Fatalf("no value log manifest: %v", err)
+	}
+	for _, name := range manifests {
+		if err := os.Remove(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if legacy, err := isLegacyValues(valuePath); err != nil || legacy {
+		t.Fatalf("isLegacyValues: got %v, %v, want current", legacy, err)
+	}
+	db, err = OpenFile(dbpath, nil)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	if v, err := db.Get([]byte("foo"), nil); err != nil || string(v) != value {
+		t.Errorf("Get: got %q, %v", v, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal("Close: got error: ", err)
+	}
+
+	// A value log that is neither current nor legacy is corrupted.
+	if err := os.RemoveAll(valuePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(valuePath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(valuePath, "level_0_number_1.value"), bytes.Repeat([]byte{0xff}, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenFile(dbpath, nil); !errors.IsCorrupted(err) {
+		t.Fatalf("OpenFile: got error %v, want ErrCorrupted", err)
+	}
+}
+
+func (h *dbHarness) valueLogStats() *DBStats {
+	s := new(DBStats)
+	if err := h.db.Stats(s); err != nil {
+		h.t.Fatal("Stats: got error: ", err)
+	}
+	return s
+}
+
+func TestDB_ValueLogRecount(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Compression:                  opt.NoCompression,
+		ValueLogFileSize:             4 * opt.KiB,
+		ValueLogGCPaused:             true,
+	})
+	defer h.close()
+
+	for r := 0; r < 2; r++ {
+		for i := 0; i < 16; i++ {
+			h.put(fmt.Sprintf("k%02d", i), string(tval(r*16+i, 1000)))
+		}
+	}
+	h.compactMem()
+	h.compactRange("", "")
+	h.closeDB()
+
+	// The dead bytes are lost along with the manifest.
+	fds, err := h.stor.List(storage.TypeValueManifest)
+	if err != nil {
+		t.Fatal("List: got error: ", err)
+	}
+	for _, fd := range fds {
+		if err := h.stor.Remove(fd); err != nil {
+			t.Fatal("Remove: got error: ", err)
+		}
+	}
+	h.openDB()
+	for i := 0; ; i++ {
+		if s := h.valueLogStats(); s.ValueLogLiveSize < s.ValueLogSize {
+			break
+		} else if i == 100 {
+			t.Fatal("dead bytes not recounted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := h.db.CompactValueLog(context.Background()); err != nil {
+		t.Fatal("CompactValueLog: got error: ", err)
+	}
+	s := h.valueLogStats()
+	if s.ValueLogLiveSize != s.ValueLogSize || s.ValueLogSize > 16*1100 {
+		t.Errorf("garbage left: size=%d live=%d", s.ValueLogSize, s.ValueLogLiveSize)
+	}
+	for i := 0; i < 16; i++ {
+		h.getVal(fmt.Sprintf("k%02d", i), string(tval(16+i, 1000)))
+	}
+
+	// The values of a write that failed are referred to by no key.
+	h.stor.EmulateErrorOnce(testutil.ModeWrite, storage.TypeJournal, errors.New("journal write error"))
+	if err := h.db.Put([]byte("foo"), tval(100, 1000), h.wo); err == nil {
+		t.Fatal("Put: expecting error")
+	}
+	h.reopenDB()
+	if s := h.valueLogStats(); s.ValueLogLiveSize == s.ValueLogSize {
+		t.Error("failed write not accounted dead")
+	}
+	if err := h.db.CompactValueLog(context.Background()); err != nil {
+		t.Fatal("CompactValueLog: got error: ", err)
+	}
+	if s := h.valueLogStats(); s.ValueLogLiveSize != s.ValueLogSize || s.ValueLogSize > 16*1100 {
+		t.Errorf("garbage left: size=%d live=%d", s.ValueLogSize, s.ValueLogLiveSize)
+	}
+	h.get("foo", false)
+}
+
+// cancelledContext reports being cancelled through Err while its Done
+// channel never closes, so the code under test stops at its ctx.Err checks.
+type cancelledContext struct {
+	context.Context
+}
+
+func (cancelledContext) Err() error {
+	return context.Canceled
+}
+
+func TestDB_ValueLogRecountCancelled(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Compression:                  opt.NoCompression,
+		ValueLogGCPaused:             true,
+	})
+	defer h.close()
+
+	for i := 0; i < 16; i++ {
+		h.put(fmt.Sprintf("k%02d", i), string(tval(i, 1000)))
+	}
+	vs := h.db.s.vStore
+	recount := func() bool {
+		vs.Mutex.Lock()
+		defer vs.Mutex.Unlock()
+		return vs.Recount
+	}
+	vs.gcSem <- struct{}{}
+	defer func() {
+		<-vs.gcSem
+	}()
+	vs.Mutex.Lock()
+	vs.Recount = true
+	vs.Mutex.Unlock()
+
+	if err := vs.recount(cancelledContext{context.Background()}); err != context.Canceled {
+		t.Fatalf("recount: got error %v, want %v", err, context.Canceled)
+	}
+	if !recount() {
+		t.Error("recount cut short but no longer pending")
+	}
+	if err := vs.recount(context.Background()); err != nil {
+		t.Fatal("recount: got error: ", err)
+	}
+	if recount() {
+		t.Error("recount done but still pending")
+	}
+}
+
+func TestDB_ValueLogTransactionDead(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Compression:                  opt.NoCompression,
+		ValueLogGCPaused:             true,
+	})
+	defer h.close()
+
+	put := func(tr *Transaction, r int) {
+		for i := 0; i < 10; i++ {
+			if err := tr.Put([]byte(fmt.Sprintf("k%d", i)), tval(r*10+i, 1000), h.wo); err != nil {
+				t.Fatal("Put: got error: ", err)
+			}
+		}
+	}
+
+	tr, err := h.db.OpenTransaction()
+	if err != nil {
+		t.Fatal("OpenTransaction: got error: ", err)
+	}
+	put(tr, 0)
+	tr.Discard()
+	s := h.valueLogStats()
+	if s.ValueLogSize < 10*1000 || s.ValueLogLiveSize != 0 {
+		t.Errorf("discarded values not accounted dead: size=%d live=%d", s.ValueLogSize, s.ValueLogLiveSize)
+	}
+	discarded := s.ValueLogSize
+
+	tr, err = h.db.OpenTransaction()
+	if err != nil {
+		t.Fatal("OpenTransaction: got error: ", err)
+	}
+	put(tr, 1)
+	h.stor.EmulateErrorOnce(testutil.ModeCreate, storage.TypeTable, errors.New("table create error"))
+	if err := tr.Commit(); err == nil {
+		t.Fatal("Commit: expecting error")
+	}
+	if s := h.valueLogStats(); s.ValueLogLiveSize != 0 {
+		t.Errorf("values of failed commit not accounted dead: size=%d live=%d", s.ValueLogSize, s.ValueLogLiveSize)
+	}
+
+	// The values are live again once a retry commits them.
+	put(tr, 2)
+	if err := tr.Commit(); err != nil {
+		t.Fatal("Commit: got error: ", err)
+	}
+	s = h.valueLogStats()
+	if live := s.ValueLogSize - discarded; s.ValueLogLiveSize != live {
+		t.Errorf("committed values not accounted live: size=%d live=%d, want live=%d", s.ValueLogSize, s.ValueLogLiveSize, live)
+	}
+	for i := 0; i < 10; i++ {
+		h.getVal(fmt.Sprintf("k%d", i), string(tval(20+i, 1000)))
+	}
+}
+
+func TestDB_RecoverValueLog(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Compression:                  opt.NoCompression,
+		ValueLogFileSize:             4 * opt.KiB,
+		ValueLogGCPaused:             true,
+	})
+	defer h.close()
+
+	for r := 0; r < 2; r++ {
+		for i := 0; i < 16; i++ {
+			h.put(fmt.Sprintf("k%02d", i), string(tval(r*16+i, 1000)))
+		}
+	}
+	h.put("small", "v")
+	h.compactMem()
+	h.compactRange("", "")
+	h.closeDB()
+
+	// Both manifests are ignored, corrupted or not.
+	fds, err := h.stor.List(storage.TypeManifest | storage.TypeValueManifest)
+	if err != nil {
+		t.Fatal("List: got error: ", err)
+	}
+	for _, fd := range fds {
+		h.writeFile(fd, []byte("corrupted"))
+	}
+	if h.db, err = Recover(h.stor, h.o); err != nil {
+		t.Fatal("Recover: got error: ", err)
+	}
+	for i := 0; i < 16; i++ {
+		h.getVal(fmt.Sprintf("k%02d", i), string(tval(16+i, 1000)))
+	}
+	h.getVal("small", "v")
+	if err := h.db.CompactValueLog(context.Background()); err != nil {
+		t.Fatal("CompactValueLog: got error: ", err)
+	}
+	if s := h.valueLogStats(); s.ValueLogLiveSize != s.ValueLogSize || s.ValueLogSize > 16*1100 {
+		t.Errorf("garbage left: size=%d live=%d", s.ValueLogSize, s.ValueLogLiveSize)
+	}
+	h.put("foo", string(tval(100, 1000)))
+	h.reopenDB()
+	for i := 0; i < 16; i++ {
+		h.getVal(fmt.Sprintf("k%02d", i), string(tval(16+i, 1000)))
+	}
+	h.getVal("foo", string(tval(100, 1000)))
+	h.closeDB()
+
+	// A key whose value file is lost is reported on read, the others are
+	// recovered.
+	fd, _ := h.lastValueFile()
+	if err := h.stor.Remove(fd); err != nil {
+		t.Fatal("Remove: got error: ", err)
+	}
+	if h.db, err = Recover(h.stor, h.o); err != nil {
+		t.Fatal("Recover: got error: ", err)
+	}
+	if _, err := h.db.Get([]byte("foo"), h.ro); !errors.IsCorrupted(err) {
+		t.Errorf("Get: got error %v, want ErrCorrupted", err)
+	}
+	for i := 0; i < 16; i++ {
+		h.getVal(fmt.Sprintf("k%02d", i), string(tval(16+i, 1000)))
+	}
+	if report := h.db.RecoveryReport(); len(report.Problems) != 1 || string(report.Problems[0].Key) != "foo" {
+		t.Errorf("RecoveryReport: got %d problems, want foo", len(report.Problems))
+	}
+}
+
+func TestDB_RecoverValueLogDangling(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Compression:                  opt.NoCompression,
+	})
+	defer h.close()
+
+	for i := 0; i < 8; i++ {
+		h.put(fmt.Sprintf("k%d", i), string(tval(i, 1000)))
+	}
+	h.put("small", "v")
+	h.compactMem()
+	h.closeDB()
+
+	// Truncate the value file in the middle of the sixth record.
+	fd, content := h.lastValueFile()
+	rl := len(content) / 8
+	h.writeFile(fd, content[:5*rl+rl/2])
+	fds, err := h.stor.List(storage.TypeManifest | storage.TypeValueManifest)
+	if err != nil {
+		t.Fatal("List: got error: ", err)
+	}
+	for _, fd := range fds {
+		h.writeFile(fd, []byte("corrupted"))
+	}
+
+	if h.db, err = Recover(h.stor, h.o); err != nil {
+		t.Fatal("Recover: got error: ", err)
+	}
+	report := h.db.RecoveryReport()
+	if report == nil {
+		t.Fatal("RecoveryReport: got nil report")
+	}
+	if report.Keys != 9 || report.Separated != 8 {
+		t.Errorf("RecoveryReport: got keys=%d separated=%d, want keys=9 separated=8", report.Keys, report.Separated)
+	}
+	if len(report.Problems) != 3 {
+		t.Fatalf("RecoveryReport: got %d problems, want 3", len(report.Problems))
+	}
+	for i, p := range report.Problems {
+		if key := fmt.Sprintf("k%d", 5+i); string(p.Key) != key || !errors.IsCorrupted(p.Err) {
+			t.Errorf("RecoveryReport: problem #%d: got key %q error %v, want key %q ErrCorrupted", i, p.Key, p.Err, key)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		h.getVal(fmt.Sprintf("k%d", i), string(tval(i, 1000)))
+	}
+	h.getVal("small", "v")
+
+	h.reopenDB()
+	if report := h.db.RecoveryReport(); report != nil {
+		t.Errorf("RecoveryReport: got a report from Open")
+	}
+}
+
+func TestDB_RecoverFileValueLog(t *testing.T) {
+	dbpath, err := ioutil.TempDir("", "goleveldbtestRecoverFileValueLog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbpath)
+
+	db, err := OpenFile(dbpath, nil)
+	if err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	for i := 0; i < 16; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("k%02d", i)), tval(i, 1000), nil); err != nil {
+			t.Fatal("Put: got error: ", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal("Close: got error: ", err)
+	}
+	for _, pattern := range []string{"key/MANIFEST-*", "value/VMANIFEST-*"} {
+		names, err := filepath.Glob(filepath.Join(dbpath, pattern))
+		if err != nil || len(names) == 0 {
+			t.Fatalf("no %s: %v", pattern, err)
+		}
+		for _, name := range names {
+			if err := os.Remove(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	check := func(db *DB) {
+		t.Helper()
+		for i := 0; i < 16; i++ {
+			if v, err := db.Get([]byte(fmt.Sprintf("k%02d", i)), nil); err != nil || !bytes.Equal(v, tval(i, 1000)) {
+				t.Errorf("Get k%02d: got error %v or invalid value", i, err)
+			}
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal("Close: got error: ", err)
+		}
+	}
+	if db, err = RecoverFile(dbpath, nil); err != nil {
+		t.Fatal("RecoverFile: got error: ", err)
+	}
+	check(db)
+	if db, err = OpenFile(dbpath, nil); err != nil {
+		t.Fatal("OpenFile: got error: ", err)
+	}
+	check(db)
+}
+
+func TestDB_VerifyValueLog(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Compression:                  opt.NoCompression,
+		ValueLogFileSize:             4 * opt.KiB,
+	})
+	defer h.close()
+
+	for i := 0; i < 16; i++ {
+		h.put(fmt.Sprintf("k%02d", i), string(tval(i, 1000)))
+	}
+	h.put("small", "v")
+	h.closeDB()
+
+	// Lose the values of the last keys written.
+	fd, _ := h.lastValueFile()
+	if err := h.stor.Remove(fd); err != nil {
+		t.Fatal("Remove: got error: ", err)
+	}
+
+	verify := func(repair bool) *ValueLogReport {
+		t.Helper()
+		report, err := h.db.VerifyValueLog(repair)
+		if err != nil {
+			t.Fatal("VerifyValueLog: got error: ", err)
+		}
+		return report
+	}
+	h.o.ReadOnly = true
+	h.openDB()
+	report := verify(false)
+	if report.Keys != 17 || report.Separated != 16 || report.Repaired != 0 {
+		t.Errorf("got keys=%d separated=%d repaired=%d, want 17, 16 and 0", report.Keys, report.Separated, report.Repaired)
+	}
+	if len(report.Problems) == 0 || len(report.Problems) == 16 {
+		t.Fatalf("got %d broken keys", len(report.Problems))
+	}
+	broken := make(map[string]bool)
+	for _, p := range report.Problems {
+		if !errors.IsCorrupted(p.Err) {
+			t.Errorf("%q: got error %v, want ErrCorrupted", p.Key, p.Err)
+		}
+		broken[string(p.Key)] = true
+	}
+	h.closeDB()
+
+	h.o.ReadOnly = false
+	h.openDB()
+	report = verify(true)
+	if report.Repaired != len(broken) || len(report.Problems) != len(broken) {
+		t.Errorf("got %d broken and %d repaired keys, want %d", len(report.Problems), report.Repaired, len(broken))
+	}
+	for i := 0; i < 16; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		if broken[key] {
+			h.get(key, false)
+		} else {
+			h.getVal(key, string(tval(i, 1000)))
+		}
+	}
+	h.getVal("small", "v")
+	if report := verify(false); len(report.Problems) != 0 || report.Keys != 17-len(broken) {
+		t.Errorf("after repair: got %d keys, %d broken", report.Keys, len(report.Problems))
+	}
+}
+
+func TestDB_ValueLogFilesCache(t *testing.T) {
+	for _, test := range []struct {
+		capacity          int
+		disableBufferPool bool
+		opens             int
+	}{
+		{0, false, 4},
+		{0, true, 4},
+		{-1, false, 32},
+	} {
+		t.Run(fmt.Sprintf("capacity=%d,disableBufferPool=%v", test.capacity, test.disableBufferPool), func(t *testing.T) {
+			h := newDbHarnessWopt(t, &opt.Options{
+				DisableLargeBatchTransaction: true,
+				Compression:                  opt.NoCompression,
+				ValueLogFileSize:             4 * opt.KiB,
+				ValueLogFilesCacheCapacity:   test.capacity,
+				DisableBufferPool:            test.disableBufferPool,
+			})
+			defer h.close()
+
+			// 4 values per file.
+			for i := 0; i < 16; i++ {
+				h.put(fmt.Sprintf("k%02d", i), string(tval(i, 1000)))
+			}
+			h.reopenDB()
+			h.stor.ResetCounter(testutil.ModeOpen, storage.TypeValue)
+			for r := 0; r < 2; r++ {
+				for i := 0; i < 16; i++ {
+					h.getVal(fmt.Sprintf("k%02d", i), string(tval(i, 1000)))
+				}
+			}
+			if n, _ := h.stor.Counter(testutil.ModeOpen, storage.TypeValue); n != test.opens {
+				t.Errorf("value files opened %d times, want %d", n, test.opens)
+			}
+		})
+	}
+}
+
+func TestDB_ValueCache(t *testing.T) {
+	for _, capacity := range []int{0, opt.MiB} {
+		t.Run(fmt.Sprintf("capacity=%d", capacity), func(t *testing.T) {
+			h := newDbHarnessWopt(t, &opt.Options{
+				DisableLargeBatchTransaction: true,
+				Compression:                  opt.NoCompression,
+				ValueLogFileSize:             4 * opt.KiB,
+				ValueLogCacheCapacity:        capacity,
+				ValueLogGCPaused:             true,
+			})
+			defer h.close()
+
+			for i := 0; i < 16; i++ {
+				h.put(fmt.Sprintf("k%02d", i), string(tval(i, 1000)))
+			}
+			h.stor.ResetCounter(testutil.ModeRead, storage.TypeValue)
+			for r := 0; r < 2; r++ {
+				for i := 0; i < 16; i++ {
+					v, err := h.db.Get([]byte(fmt.Sprintf("k%02d", i)), h.ro)
+					if err != nil || !bytes.Equal(v, tval(i, 1000)) {
+						t.Fatalf("Get k%02d: got error %v or invalid value", i, err)
+					}
+					// The cached value is not handed out.
+					v[0]++
+				}
+			}
+			s := h.valueLogStats()
+			_, read := h.stor.Counter(testutil.ModeRead, storage.TypeValue)
+			if capacity == 0 {
+				if s.ValueCacheSize != 0 || s.ValueCacheHits != 0 || s.ValueCacheMisses != 0 {
+					t.Errorf("value cache disabled: got size=%d hits=%d misses=%d", s.ValueCacheSize, s.ValueCacheHits, s.ValueCacheMisses)
+				}
+				if read < 32*1000 {
+					t.Errorf("read %d bytes, want at least %d", read, 32*1000)
+				}
+				return
+			}
+			if s.ValueCacheHits != 16 || s.ValueCacheMisses != 16 || s.ValueCacheSize != 16*1000 {
+				t.Errorf("got size=%d hits=%d misses=%d, want 16000, 16 and 16", s.ValueCacheSize, s.ValueCacheHits, s.ValueCacheMisses)
+			}
+			if read >= 32*1000 {
+				t.Errorf("read %d bytes, want less than %d", read, 32*1000)
+			}
+
+			// The values of a compacted file are evicted along with it.
+			for i := 0; i < 8; i++ {
+				h.put(fmt.Sprintf("k%02d", i), string(tval(100+i, 1000)))
+			}
+			h.compactMem()
+			h.compactRange("", "")
+			if err := h.db.CompactValueLog(context.Background()); err != nil {
+				t.Fatal("CompactValueLog: got error: ", err)
+			}
+			if s := h.valueLogStats(); s.ValueCacheSize != 8*1000 {
+				t.Errorf("after compaction: got size=%d, want 8000", s.ValueCacheSize)
+			}
+			for i := 0; i < 16; i++ {
+				want := tval(i, 1000)
+				if i < 8 {
+					want = tval(100+i, 1000)
+				}
+				h.getVal(fmt.Sprintf("k%02d", i), string(want))
+			}
+		})
+	}
+}
+
+func TestDB_ValueLogCompression(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Compression:                  opt.SnappyCompression,
+		ValueLogGCPaused:             true,
+	})
+	defer h.close()
+
+	compressible := strings.Repeat("compressible", 1000)
+	incompressible := string(tval(0, 10000))
+	h.put("c1", compressible)
+	h.put("i1", incompressible)
+	if s := h.valueLogStats(); s.ValueLogSize >= int64(len(compressible)+len(incompressible)) {
+		t.Errorf("values not compressed, value log size=%d", s.ValueLogSize)
+	}
+
+	// Readable whatever the compression the DB is opened with.
+	h.o.Compression = opt.NoCompression
+	h.reopenDB()
+	h.getVal("c1", compressible)
+	h.getVal("i1", incompressible)
+	size := h.valueLogStats().ValueLogSize
+	h.put("c2", compressible)
+	if s := h.valueLogStats(); s.ValueLogSize-size < int64(len(compressible)) {
+		t.Errorf("value compressed, %d bytes appended", s.ValueLogSize-size)
+	}
+
+	// Relocated records keep their compression.
+	h.o.Compression = opt.SnappyCompression
+	h.reopenDB()
+	h.put("i1", "x")
+	h.compactMem()
+	h.compactRange("", "")
+	if err := h.db.CompactValueLog(context.Background()); err != nil {
+		t.Fatal("CompactValueLog: got error: ", err)
+	}
+	if s := h.valueLogStats(); s.ValueLogGCRelocated == 0 || s.ValueLogGCRelocated >= int64(len(compressible)) {
+		t.Errorf("relocated %d bytes", s.ValueLogGCRelocated)
+	}
+	h.reopenDB()
+	h.getVal("c1", compressible)
+	h.getVal("c2", compressible)
+	h.getVal("i1", "x")
+}
+
+func TestDB_ValuePrefetch(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Compression:                  opt.NoCompression,
+		ValueLogFileSize:             8 * opt.KiB,
+	})
+	defer h.close()
+
+	// Every third value is inline.
+	value := func(i int) string {
+		if i%3 == 0 {
+			return fmt.Sprintf("v%d", i)
+		}
+		return string(tval(i, 1000))
+	}
+	for i := 0; i < 32; i++ {
+		h.put(fmt.Sprintf("k%02d", i), value(i))
+	}
+	h.compactMem()
+	h.reopenDB()
+
+	ro := &opt.ReadOptions{ValuePrefetch: 4}
+	iter := h.db.NewIterator(nil, ro)
+	defer iter.Release()
+	assert := func(ok bool, i int) {
+		t.Helper()
+		if !ok {
+			t.Fatalf("k%02d: got no key", i)
+		}
+		if key := fmt.Sprintf("k%02d", i); string(iter.Key()) != key {
+			t.Fatalf("got key %q, want %q", iter.Key(), key)
+		}
+		if string(iter.Value()) != value(i) {
+			t.Fatalf("k%02d: invalid value, error: %v", i, iter.Error())
+		}
+	}
+
+	// The values following the first are read ahead.
+	h.stor.ResetCounter(testutil.ModeRead, storage.TypeValue)
+	assert(iter.First(), 0)
+	for i := 0; ; i++ {
+		if n, _ := h.stor.Counter(testutil.ModeRead, storage.TypeValue); n >= 2 {
+			break
+		} else if i == 100 {
+			t.Fatal("no value read ahead")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 1; i < 12; i++ {
+		assert(iter.Next(), i)
+	}
+	// Moving back reads the values directly, moving forward again starts
+	// over from there.
+	assert(iter.Prev(), 10)
+	assert(iter.Prev(), 9)
+	assert(iter.Next(), 10)
+	assert(iter.Next(), 11)
+	assert(iter.Seek([]byte("k20")), 20)
+	assert(iter.Next(), 21)
+	assert(iter.Seek([]byte("k05")), 5)
+	assert(iter.Next(), 6)
+	assert(iter.Last(), 31)
+	assert(iter.Prev(), 30)
+	assert(iter.Next(), 31)
+	if iter.Next() {
+		t.Fatal("Next: got key past the last")
+	}
+	assert(iter.First(), 0)
+	// Values skipped over are never waited for.
+	for i := 1; i < 32; i++ {
+		if !iter.Next() {
+			t.Fatalf("k%02d: got no key", i)
+		}
+	}
+	assert(iter.Seek([]byte("k16")), 16)
+	if err := iter.Error(); err != nil {
+		t.Fatal("iterator: got error: ", err)
+	}
+
+	// Within a range.
+	riter := h.db.NewIterator(&util.Range{Start: []byte("k08"), Limit: []byte("k16")}, ro)
+	n := 0
+	for riter.Next() {
+		if string(riter.Value()) != value(8+n) {
+			t.Errorf("range: k%02d: invalid value", 8+n)
+		}
+		n++
+	}
+	if err := riter.Error(); err != nil || n != 8 {
+		t.Errorf("range: got %d keys, error: %v", n, err)
+	}
+	riter.Release()
+	h.closeDB()
+
+	// A value that can't be read ahead is reported when it is reached.
+	fd, _ := h.lastValueFile()
+	if err := h.stor.Remove(fd); err != nil {
+		t.Fatal("Remove: got error: ", err)
+	}
+	h.openDB()
+	iter = h.db.NewIterator(nil, ro)
+	defer iter.Release()
+	for iter.Next() {
+		if iter.Value() == nil {
+			break
+		}
+	}
+	if err := iter.Error(); !errors.IsCorrupted(err) {
+		t.Errorf("iterator: got error %v, want ErrCorrupted", err)
+	}
+}
+
+func TestDB_ValueLogProperty(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Compression:                  opt.NoCompression,
+		ValueLogFileSize:             4 * opt.KiB,
+		ValueLogGCPaused:             true,
+	})
+	defer h.close()
+
+	for r := 0; r < 2; r++ {
+		for i := 0; i < 16; i++ {
+			h.put(fmt.Sprintf("k%02d", i), string(tval(r*16+i, 1000)))
+		}
+	}
+	h.compactMem()
+	h.compactRange("", "")
+
+	property := func() (lines []string, files int, size, dead float64) {
+		t.Helper()
+		v, err := h.db.GetProperty("leveldb.valuelog")
+		if err != nil {
+			t.Fatal("GetProperty: got error: ", err)
+		}
+		t.Logf("leveldb.valuelog:\n%s", v)
+		lines = strings.Split(v, "\n")
+		for _, line := range lines {
+			if strings.HasPrefix(line, " Total |") {
+				if _, err := fmt.Sscanf(line, " Total | %d | %f | %f", &files, &size, &dead); err != nil {
+					t.Fatalf("invalid total %q: %v", line, err)
+				}
+				return
+			}
+		}
+		t.Fatal("no total")
+		return
+	}
+	s := h.valueLogStats()
+	lines, files, size, dead := property()
+	if lines[0] != "Value log" || !strings.HasPrefix(lines[3], "   0   |") {
+		t.Error("unexpected layout")
+	}
+	mb := func(n int64) float64 { return float64(n) / 1048576 }
+	if files != s.ValueLogLevelFiles[0] || math.Abs(size-mb(s.ValueLogSize)) > 1e-5 || math.Abs(dead-mb(s.ValueLogSize-s.ValueLogLiveSize)) > 1e-5 {
+		t.Errorf("total files=%d size=%f dead=%f, stats %+v", files, size, dead, s)
+	}
+	if dead == 0 {
+		t.Error("no dead bytes")
+	}
+
+	if err := h.db.CompactValueLog(context.Background()); err != nil {
+		t.Fatal("CompactValueLog: got error: ", err)
+	}
+	lines, _, _, dead = property()
+	if dead != 0 {
+		t.Errorf("dead bytes after compaction: %f", dead)
+	}
+	if !strings.HasPrefix(lines[4], "   1   |") {
+		t.Error("no level 1 files")
+	}
+	if last := lines[len(lines)-2]; !strings.HasPrefix(last, "GCRuns:1 ") {
+		t.Errorf("unexpected GC stats %q", last)
+	}
+	if _, err := h.db.GetProperty("leveldb.valuelogx"); err != ErrNotFound {
+		t.Errorf("GetProperty: got error %v, want ErrNotFound", err)
+	}
+}
+
+func TestDB_ValueLogGCPauseResume(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Compression:                  opt.NoCompression,
+		ValueLogFileSize:             4 * opt.KiB,
+		ValueLogMaxSize:              16 * opt.KiB,
+		ValueLogGCPaused:             true,
+	})
+	defer h.close()
+
+	for r := 0; r < 2; r++ {
+		for i := 0; i < 16; i++ {
+			h.put(fmt.Sprintf("k%02d", i), string(tval(r*16+i, 1000)))
+		}
+	}
+	h.compactMem()
+	h.compactRange("", "")
+	if s := h.valueLogStats(); s.ValueLogGCRuns != 0 || s.ValueLogLiveSize == s.ValueLogSize {
+		t.Fatalf("paused: got %d runs, size=%d live=%d", s.ValueLogGCRuns, s.ValueLogSize, s.ValueLogLiveSize)
+	}
+
+	h.db.ResumeValueLogGC()
+	for i := 0; ; i++ {
+		if s := h.valueLogStats(); s.ValueLogGCRuns > 0 && s.ValueLogLiveSize == s.ValueLogSize {
+			break
+		} else if i == 100 {
+			t.Fatalf("resumed: got %d runs, size=%d live=%d", s.ValueLogGCRuns, s.ValueLogSize, s.ValueLogLiveSize)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Paused again, the garbage is only collected by CompactValueLog.
+	h.db.PauseValueLogGC()
+	runs := h.valueLogStats().ValueLogGCRuns
+	for r := 0; r < 2; r++ {
+		for i := 0; i < 16; i++ {
+			h.put(fmt.Sprintf("k%02d", i), string(tval(100+r*16+i, 1000)))
+		}
+	}
+	h.compactMem()
+	h.compactRange("", "")
+	time.Sleep(50 * time.Millisecond)
+	if s := h.valueLogStats(); s.ValueLogGCRuns != runs {
+		t.Fatalf("paused: got %d runs, want %d", s.ValueLogGCRuns, runs)
+	}
+	if err := h.db.CompactValueLog(context.Background()); err != nil {
+		t.Fatal("CompactValueLog: got error: ", err)
+	}
+	if s := h.valueLogStats(); s.ValueLogGCRuns != runs+1 || s.ValueLogLiveSize != s.ValueLogSize {
+		t.Errorf("got %d runs, size=%d live=%d", s.ValueLogGCRuns, s.ValueLogSize, s.ValueLogLiveSize)
+	}
+	for i := 0; i < 16; i++ {
+		h.getVal(fmt.Sprintf("k%02d", i), string(tval(116+i, 1000)))
+	}
+}
+
+func TestDB_ValueLogGCRateLimit(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Compression:                  opt.NoCompression,
+		ValueLogFileSize:             4 * opt.KiB,
+		ValueLogGCPaused:             true,
+		ValueLogGCRateLimit:          64 * opt.KiB,
+	})
+	defer h.close()
+
+	// Every other value of each file is dead, 16KiB are read and 8KiB
+	// written.
+	for i := 0; i < 16; i++ {
+		h.put(fmt.Sprintf("k%02d", i), string(tval(i, 1000)))
+	}
+	for i := 0; i < 16; i += 2 {
+		h.delete(fmt.Sprintf("k%02d", i))
+	}
+	h.compactMem()
+	h.compactRange("", "")
+	start := time.Now()
+	if err := h.db.CompactValueLog(context.Background()); err != nil {
+		t.Fatal("CompactValueLog: got error: ", err)
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Errorf("compaction took %v, want at least 300ms", d)
+	}
+	for i := 1; i < 16; i += 2 {
+		h.getVal(fmt.Sprintf("k%02d", i), string(tval(i, 1000)))
+	}
+
+	// A rate limited compaction stops once its context is done.
+	for i := 1; i < 16; i += 4 {
+		h.delete(fmt.Sprintf("k%02d", i))
+	}
+	h.compactMem()
+	h.compactRange("", "")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := h.db.CompactValueLog(ctx); err != context.DeadlineExceeded {
+		t.Errorf("CompactValueLog: got error %v, want context.DeadlineExceeded", err)
+	}
+	for i := 3; i < 16; i += 4 {
+		h.getVal(fmt.Sprintf("k%02d", i), string(tval(i, 1000)))
+	}
+}
+
+func TestDB_ValueLogCloseDuringGC(t *testing.T) {
+	h := newDbHarnessWopt(t, &opt.Options{
+		DisableLargeBatchTransaction: true,
+		Compression:                  opt.NoCompression,
+		ValueLogFileSize:             4 * opt.KiB,
+		ValueLogMaxSize:              16 * opt.KiB,
+		ValueLogGCPaused:             true,
+		ValueLogGCRateLimit:          16 * opt.KiB,
+	})
+	defer h.close()
+
+	for r := 0; r < 2; r++ {
+		for i := 0; i < 16; i++ {
+			h.put(fmt.Sprintf("k%02d", i), string(tval(r*16+i, 1000)))
+		}
+	}
+	h.compactMem()
+	h.compactRange("", "")
+
+	// Both a manual and a background compaction, whichever gets to run,
+	// are stopped by Close.
+	errc := make(chan error, 1)
+	go func() {
+		errc <- h.db.CompactValueLog(context.Background())
+	}()
+	h.db.ResumeValueLogGC()
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	h.closeDB()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Close took %v", d)
+	}
+	if err := <-errc; err != nil && err != ErrClosed {
+		t.Errorf("CompactValueLog: got error %v, want ErrClosed", err)
+	}
+	if err := h.db.CompactValueLog(context.Background()); err != ErrClosed {
+		t.Errorf("CompactValueLog after Close: got error %v, want ErrClosed", err)
+	}
+	h.db.ResumeValueLogGC()
+
+	h.o.ValueLogGCRateLimit = 0
+	h.openDB()
+	for i := 0; i < 16; i++ {
+		h.getVal(fmt.Sprintf("k%02d", i), string(tval(16+i, 1000)))
+	}
+	if err := h.db.CompactValueLog(context.Background()); err != nil {
+		t.Fatal("CompactValueLog: got error: ", err)
+	}
+	for i := 0; i < 16; i++ {
+		h.getVal(fmt.Sprintf("k%02d", i), string(tval(16+i, 1000)))
+	}
+}
+
+// oldValueRecord returns a value record as written before sequence numbers
+// were widened.
+func oldValueRecord(key, value string, seq uint32) []byte {
+	record := make([]byte, vRecordHeaderLen+len(key)+len(value))
+	binary.BigEndian.PutUint32(record[4:], uint32(len(record)))
+	binary.BigEndian.PutUint32(record[8:], uint32(len(key)))
+	binary.BigEndian.PutUint32(record[12:], uint32(len(value)))
+	binary.BigEndian.PutUint32(record[16:], seq)
+	copy(record[vRecordHeaderLen:], key)
+	copy(record[vRecordHeaderLen+len(key):], value)
+	setRecordChecksum(record)
+	return record
+}
+
+func TestDB_ValueLogFormatV0(t *testing.T) {
+	for _, stats := range []bool{true, false} {
+		t.Run(fmt.Sprintf("stats=%v", stats), func(t *testing.T) {
+			dbpath, err := ioutil.TempDir("", "goleveldbtestValueLogFormatV0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dbpath)
+			valuePath := filepath.Join(dbpath, "value")
+			o := &opt.Options{Compression: opt.NoCompression, ValueLogGCPaused: true}
+
+			db, err := OpenFile(dbpath, o)
+			if err != nil {
+				t.Fatal("OpenFile: got error: ", err)
+			}
+			newValue, oldValue := tval(0, 1000), string(tval(1, 1000))
+			if err := db.Put([]byte("new"), newValue, nil); err != nil {
+				t.Fatal("Put: got error: ", err)
+			}
+			// Two records of the old layout, pointed to by 21-byte
+			// locations and written as is, bypassing value separation.
+			const oldFile = 1000
+			old1 := oldValueRecord("old1", oldValue, 7)
+			old2 := oldValueRecord("old2", oldValue, 8)
+			batch := new(Batch)
+			batch.Put([]byte("old1"), recordLocation(old1, 0, oldFile, 0))
+			batch.Put([]byte("old2"), recordLocation(old2, 0, oldFile, len(old1)))
+			db.writeLockC <- struct{}{}
+			if err := db.writeLocked(batch, batch, false, true, false); err != nil {
+				t.Fatal("write: got error: ", err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal("Close: got error: ", err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(valuePath, fmt.Sprintf("level_0_number_%d.value", oldFile)), append(old1, old2...), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			// A version 0 manifest, by its old name.
+			names, err := filepath.Glob(filepath.Join(valuePath, "VMANIFEST-*"))
+			if err != nil || len(names) == 0 {
+				t.Fatalf("no value log manifest: %v", err)
+			}
+			for _, name := range names {
+				if err := os.Remove(name); err != nil {
+					t.Fatal(err)
+				}
+			}
+			fis, err := ioutil.ReadDir(valuePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var (
+				state     = make([]byte, ManifestSize)
+				fileStats []byte
+				size      int64
+				start     = oldFile
+			)
+			for _, fi := range fis {
+				var level, num int
+				if _, err := fmt.Sscanf(fi.Name(), "level_%d_number_%d.value", &level, &num); err != nil {
+					continue
+				}
+				if num < start {
+					start = num
+				}
+				size += fi.Size()
+				var stat [fileStatLen]byte
+				binary.BigEndian.PutUint32(stat[0:], uint32(level))
+				binary.BigEndian.PutUint32(stat[4:], uint32(num))
+				binary.BigEndian.PutUint64(stat[8:], uint64(fi.Size()))
+				fileStats = append(fileStats, stat[:]...)
+			}
+			binary.BigEndian.PutUint32(state[0:], 9)
+			binary.BigEndian.PutUint64(state[4:], uint64(size))
+			binary.BigEndian.PutUint32(state[12:], oldFile)
+			binary.BigEndian.PutUint32(state[16:], uint32(len(old1)+len(old2)))
+			binary.BigEndian.PutUint32(state[20:], uint32(start))
+			binary.BigEndian.PutUint32(state[24:], oldFile)
+			if stats {
+				var n [4]byte
+				binary.BigEndian.PutUint32(n[:], uint32(len(fileStats)/fileStatLen))
+				state = append(append(state, n[:]...), fileStats...)
+			}
+			f, err := os.Create(filepath.Join(valuePath, Manifest))
+			if err != nil {
+				t.Fatal(err)
+			}
+			jw := journal.NewWriter(f)
+			w, err := jw.Next()
+			if err == nil {
+				_, err = w.Write(state)
+			}
+			if err == nil {
+				err = jw.Close()
+			}
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			check := func(db *DB, keys ...string) {
+				t.Helper()
+				for _, key := range keys {
+					want := oldValue
+					if key == "new" {
+						want = string(newValue)
+					}
+					if v, err := db.Get([]byte(key), nil); err != nil || string(v) != want {
+						t.Errorf("Get %q: got error %v or invalid value", key, err)
+					}
+				}
+			}
+			if db, err = OpenFile(dbpath, o); err != nil {
+				t.Fatal("OpenFile: got error: ", err)
+			}
+			check(db, "new", "old1", "old2")
+
+			// The live record of the old layout is relocated along with
+			// its location.
+			if err := db.Delete([]byte("old2"), nil); err != nil {
+				t.Fatal("Delete: got error: ", err)
+			}
+			if err := db.CompactRange(util.Range{}); err != nil {
+				t.Fatal("CompactRange: got error: ", err)
+			}
+			if err := db.CompactValueLog(context.Background()); err != nil {
+				t.Fatal("CompactValueLog: got error: ", err)
+			}
+			var s DBStats
+			if err := db.Stats(&s); err != nil {
+				t.Fatal("Stats: got error: ", err)
+			}
+			if s.ValueLogGCRelocated == 0 {
+				t.Error("no record relocated")
+			}
+			check(db, "new", "old1")
+			if err := db.Close(); err != nil {
+				t.Fatal("Close: got error: ", err)
+			}
+			if _, err := os.Stat(filepath.Join(valuePath, Manifest)); !os.IsNotExist(err) {
+				t.Errorf("version 0 manifest left: %v", err)
+			}
+			if db, err = OpenFile(dbpath, o); err != nil {
+				t.Fatal("OpenFile: got error: ", err)
+			}
+			check(db, "new", "old1")
+			if err := db.Close(); err != nil {
+				t.Fatal("Close: got error: ", err)
+			}
+		})
+	}
+}
@@ -29,6 +29,11 @@ type Transaction struct {
 	rec       sessionRecord
 	stats     cStatStaging
 	closed    bool
+
+	// Value log locations of the separated values, and whether they are
+	// accounted dead while the transaction is not committed.
+	locations [][]byte
+	dead      bool
 }
 
 // Get gets the value for the given key. It returns ErrNotFound if the
@@ -43,7 +48,11 @@ func (tr *Transaction) Get(key []byte, ro *opt.ReadOptions) ([]byte, error) {
 	if tr.closed {
 		return nil, errTransactionDone
 	}
-	return tr.db.get(tr.mem.DB, tr.tables, key, tr.seq, ro)
+	location, err := tr.db.get(tr.mem.DB, tr.tables, key, tr.seq, ro)
+	if err != nil {
+		return nil, err
+	}
+	return tr.db.s.vStore.Resolve(location)
 }
 
 // Has returns true if the DB does contains the given key.
@@ -86,7 +95,7 @@ func (tr *Transaction) NewIterator(slice *util.Range, ro *opt.ReadOptions) itera
 		return iterator.NewEmptyIterator(errTransactionDone)
 	}
 	tr.mem.incref()
-	return tr.db.newIterator(tr.mem, tr.tables, tr.seq, slice, ro)
+	return tr.db.newIterator(tr.mem, tr.tables, tr.seq, tr.db.acquireSnapshot(), slice, ro)
 }
 
 func (tr *Transaction) flush() error {
@@ -116,6 +125,30 @@ func (tr *Transaction) flush() error {
 }
 
 func (tr *Transaction) put(kt keyType, key, value []byte) error {
+	var location []byte
+	if kt == keyTypeVal {
+		v, err := tr.db.s.vStore.Separate(key, value)
+		if err != nil {
+			return err
+		}
+		if isValuePointer(v) {
+			location = v
+		}
+		value = v
+	}
+	err := tr.putMem(kt, key, value)
+	if location != nil {
+		if err != nil || tr.dead {
+			tr.markDead([][]byte{location})
+		}
+		if err == nil {
+			tr.locations = append(tr.locations, location)
+		}
+	}
+	return err
+}
+
+func (tr *Transaction) putMem(kt keyType, key, value []byte) error {
 	tr.ikScratch = makeInternalKey(tr.ikScratch, key, tr.seq+1, kt)
 	if tr.mem.Free() < len(tr.ikScratch)+len(value) {
 		if err := tr.flush(); err != nil {
@@ -129,6 +162,27 @@ func (tr *Transaction) put(kt keyType, key, value []byte) error {
 	return nil
 }
 
+// markDead accounts the values at the given locations as dead.
+func (tr *Transaction) markDead(locations [][]byte) {
+	if err := tr.db.s.vStore.markDead(locations); err != nil {
+		tr.db.logf("transaction@value error %q", err)
+	}
+}
+
+// setDead accounts the values of the transaction as dead or live. Values of
+// a transaction that is not committed are dead, unless a retry commits it.
+func (tr *Transaction) setDead(dead bool) {
+	if dead == tr.dead {
+		return
+	}
+	tr.dead = dead
+	if dead {
+		tr.markDead(tr.locations)
+	} else if err := tr.db.s.vStore.markLive(tr.locations); err != nil {
+		tr.db.logf("transaction@value error %q", err)
+	}
+}
+
 // Put sets the value for the given key. It overwrites any previous value
 // for that key; a DB is not a multi-map.
 // Please note that the transaction is not compacted until committed, so if you
@@ -200,12 +254,30 @@ func (tr *Transaction) Commit() error {
 	if tr.closed {
 		return errTransactionDone
 	}
-	if err := tr.flush(); err != nil {
+	if err := tr.commit(); err != nil {
 		// Return error, lets user decide either to retry or discard
 		// transaction.
+		tr.setDead(true)
+		return err
+	}
+	tr.setDead(false)
+	// Only mark as done if transaction committed successfully.
+	tr.setDone()
+	return nil
+}
+
+func (tr *Transaction) commit() error {
+	if err := tr.flush(); err != nil {
 		return err
 	}
 	if len(tr.tables) != 0 {
+		// Tables must not refer to values that are not on disk yet.
+		if !tr.db.s.o.GetNoSync() {
+			if err := tr.db.s.vStore.Sync(); err != nil {
+				return err
+			}
+		}
+
 		// Committing transaction.
 		tr.rec.setSeqNum(tr.seq)
 		tr.db.compCommitLk.Lock()
@@ -230,8 +302,6 @@ func (tr *Transaction) Commit() error {
 		}
 		tr.stats.stopTimer()
 		if cerr != nil {
-			// Return error, lets user decide either to retry or discard
-			// transaction.
 			return cerr
 		}
 
@@ -246,12 +316,11 @@ func (tr *Transaction) Commit() error {
 		// Ignore error, returns error only if transaction can't be committed.
 		tr.db.waitCompaction()
 	}
-	// Only mark as done if transaction committed successfully.
-	tr.setDone()
 	return nil
 }
 
 func (tr *Transaction) discard() {
+	tr.setDead(true)
 	// Discard transaction.
 	for _, t := range tr.tables {
 		tr.db.logf("transaction@discard @%d", t.fd.Num)
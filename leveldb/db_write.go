@@ -7,6 +7,7 @@
 package leveldb
 
 import (
+	"bytes"
 	"sync/atomic"
 	"time"
 
@@ -150,17 +151,9 @@ func (db *DB) unlockWrite(overflow bool, merged int, err error) {
 	}
 }
 
-// ourBatch is batch that we can modify.
-func (db *DB) writeLocked(batch, ourBatch *Batch, merge, sync bool) error {
-	// Try to flush memdb. This method would also trying to throttle writes
-	// if it is too fast and compaction cannot catch-up.
-	mdb, mdbFree, err := db.flush(batch.internalLen)
-	if err != nil {
-		db.unlockWrite(false, 0, err)
-		return err
-	}
-	defer mdb.decref()
-
+// ourBatch is batch that we can modify. Unless separated is set the values
+// of the batches are yet to be moved into the value log.
+func (db *DB) writeLocked(batch, ourBatch *Batch, merge, separated, sync bool) error {
 	var (
 		overflow bool
 		merged   int
@@ -175,10 +168,6 @@ func (db *DB) writeLocked(batch, ourBatch *Batch, merge, sync bool) error {
 		} else {
 			mergeLimit = 128 << 10
 		}
-		mergeCap := mdbFree - batch.internalLen
-		if mergeLimit > mergeCap {
-			mergeLimit = mergeCap
-		}
 
 	merge:
 		for mergeLimit > 0 {
@@ -224,14 +213,55 @@ func (db *DB) writeLocked(batch, ourBatch *Batch, merge, sync bool) error {
 		defer db.batchPool.Put(ourBatch)
 	}
 
+	// Move the values of the whole group into the value log at once, only
+	// their locations go through the journal and memdb. The values must be
+	// durable before their locations are.
+	if !separated {
+		sbatch := db.batchPool.Get().(*Batch)
+		sbatch.Reset()
+		defer db.batchPool.Put(sbatch)
+		if err := db.s.vStore.separateBatches(batches, sbatch); err != nil {
+			db.unlockWrite(overflow, merged, err)
+			return err
+		}
+		if sync {
+			if err := db.s.vStore.Sync(); err != nil {
+				db.s.vStore.discard(sbatch)
+				db.unlockWrite(overflow, merged, err)
+				return err
+			}
+		}
+		batches = []*Batch{sbatch}
+	}
+
+	// Try to flush memdb. This method would also trying to throttle writes
+	// if it is too fast and compaction cannot catch-up. Only the locations
+	// of the separated values take up memdb space.
+	var n int
+	for _, batch := range batches {
+		n += batch.internalLen
+	}
+	mdb, mdbFree, err := db.flush(n)
+	if err != nil {
+		if !separated {
+			db.s.vStore.discard(batches[0])
+		}
+		db.unlockWrite(overflow, merged, err)
+		return err
+	}
+	defer mdb.decref()
+
 	// Seq number.
 	seq := db.seq + 1
 
 	// Write journal.
-	//if err := db.writeJournal(batches, seq, sync); err != nil {
-	//	db.unlockWrite(overflow, merged, err)
-	//	return err
-	//}
+	if err := db.writeJournal(batches, seq, sync); err != nil {
+		if !separated {
+			db.s.vStore.discard(batches[0])
+		}
+		db.unlockWrite(overflow, merged, err)
+		return err
+	}
 
 	// Put batches.
 	for _, batch := range batches {
@@ -245,7 +275,7 @@ func (db *DB) writeLocked(batch, ourBatch *Batch, merge, sync bool) error {
 	db.addSeq(uint64(batchesLen(batches)))
 
 	// Rotate memdb if it's reach the threshold.
-	if batch.internalLen >= mdbFree {
+	if n >= mdbFree {
 		db.rotateMem(0, false)
 	}
 
@@ -314,7 +344,61 @@ func (db *DB) Write(batch *Batch, wo *opt.WriteOptions) error {
 		}
 	}
 
-	return db.writeLocked(batch, nil, merge, sync)
+	return db.writeLocked(batch, nil, merge, false, sync)
+}
+
+// relocateRecs points the keys of the given relocations to their new value
+// locations, or deletes them if the new location is nil. The check and the
+// write both happen under the write lock, so a relocation is only applied if
+// its key still points to the old location; a key written or deleted since
+// is left as is. It returns the number of relocations applied.
+func (db *DB) relocateRecs(rels []relocation, sync bool) (int, error) {
+	if err := db.ok(); err != nil {
+		return 0, err
+	}
+
+	// Acquire write lock.
+	select {
+	case db.writeLockC <- struct{}{}:
+		// Write lock acquired.
+	case err := <-db.compPerErrC:
+		// Compaction error.
+		return 0, err
+	case <-db.closeC:
+		// Closed
+		return 0, ErrClosed
+	}
+
+	batch := db.batchPool.Get().(*Batch)
+	batch.Reset()
+	se := db.acquireSnapshot()
+	for i, rel := range rels {
+		location, err := db.get(nil, nil, rel.key, se.seq, nil)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			db.releaseSnapshot(se)
+			db.batchPool.Put(batch)
+			db.unlockWrite(false, 0, err)
+			return 0, err
+		}
+		if bytes.Equal(location, rel.from) {
+			if rel.to == nil {
+				batch.appendRec(keyTypeDel, rel.key, nil)
+			} else {
+				batch.appendRec(keyTypeVal, rel.key, rel.to)
+			}
+			rels[i].applied = true
+		}
+	}
+	db.releaseSnapshot(se)
+	n := batch.Len()
+	if n == 0 {
+		db.batchPool.Put(batch)
+		db.unlockWrite(false, 0, nil)
+		return 0, nil
+	}
+	return n, db.writeLocked(batch, batch, false, true, sync)
 }
 
 func (db *DB) putRec(kt keyType, key, value []byte, wo *opt.WriteOptions) error {
@@ -359,7 +443,7 @@ func (db *DB) putRec(kt keyType, key, value []byte, wo *opt.WriteOptions) error
 	batch := db.batchPool.Get().(*Batch)
 	batch.Reset()
 	batch.appendRec(kt, key, value)
-	return db.writeLocked(batch, batch, merge, sync)
+	return db.writeLocked(batch, batch, merge, false, sync)
 }
 
 // Put sets the value for the given key. It overwrites any previous value
@@ -369,8 +453,7 @@ func (db *DB) putRec(kt keyType, key, value []byte, wo *opt.WriteOptions) error
 // It is safe to modify the contents of the arguments after Put returns but not
 // before.
 func (db *DB) Put(key, value []byte, wo *opt.WriteOptions) error {
-	location := db.s.vStore.Put(key, value)
-	return db.putRec(keyTypeVal, key, location, wo)
+	return db.putRec(keyTypeVal, key, value, wo)
 }
 
 // Delete deletes the value for the given key. Delete will not returns error if
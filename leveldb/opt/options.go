@@ -8,11 +8,13 @@
 package opt
 
 import (
+	"bytes"
 	"math"
 
 	"github.com/ccfarm/goleveldb/leveldb/cache"
 	"github.com/ccfarm/goleveldb/leveldb/comparer"
 	"github.com/ccfarm/goleveldb/leveldb/filter"
+	"github.com/ccfarm/goleveldb/leveldb/storage"
 )
 
 const (
@@ -38,6 +40,12 @@ var (
 	DefaultIteratorSamplingRate          = 1 * MiB
 	DefaultOpenFilesCacher               = LRUCacher
 	DefaultOpenFilesCacheCapacity        = 500
+	DefaultValueLogFileSize              = 512 * MiB
+	DefaultValueLogGCTargetRatio         = 0.6
+	DefaultValueLogGCTriggerRatio        = 0.8
+	DefaultValueLogMaxSize               = int64(16 * GiB)
+	DefaultValueLogFilesCacheCapacity    = 100
+	DefaultValueThreshold                = 64
 	DefaultWriteBuffer                   = 4 * MiB
 	DefaultWriteL0PauseTrigger           = 12
 	DefaultWriteL0SlowdownTrigger        = 8
@@ -137,6 +145,41 @@ const (
 	NoStrict = ^StrictAll
 )
 
+// ValueSeparation is a value separation policy, it decides which values are
+// separated into the value log.
+type ValueSeparation interface {
+	// Separate reports whether the value of the given key/value pair is
+	// separated into the value log, or else stored inline in the 'sorted
+	// table' along with its key.
+	//
+	// Separate is called concurrently. It must not modify the arguments
+	// nor keep them after it returns.
+	Separate(key, value []byte) bool
+}
+
+// ThresholdSeparation separates the values of at least the given size.
+type ThresholdSeparation int
+
+func (t ThresholdSeparation) Separate(key, value []byte) bool {
+	return len(value) >= int(t)
+}
+
+// PrefixSeparation applies the Match policy to the keys starting with
+// Prefix and the Other policy to the rest. A nil policy separates no value.
+type PrefixSeparation struct {
+	Prefix []byte
+	Match  ValueSeparation
+	Other  ValueSeparation
+}
+
+func (p *PrefixSeparation) Separate(key, value []byte) bool {
+	policy := p.Other
+	if bytes.HasPrefix(key, p.Prefix) {
+		policy = p.Match
+	}
+	return policy != nil && policy.Separate(key, value)
+}
+
 // Options holds the optional parameters for the DB at large.
 type Options struct {
 	// AltFilters defines one or more 'alternative filters'.
@@ -250,7 +293,9 @@ type Options struct {
 	// The default value uses the same ordering as bytes.Compare.
 	Comparer comparer.Comparer
 
-	// Compression defines the 'sorted table' block compression to use.
+	// Compression defines the 'sorted table' block compression to use. It
+	// also applies to the values stored in the value log, a value is kept
+	// uncompressed if compression does not make it notably smaller.
 	//
 	// The default value (DefaultCompression) uses snappy compression.
 	Compression Compression
@@ -286,6 +331,14 @@ type Options struct {
 	// The default is false.
 	DisableSeeksCompaction bool
 
+	// DisableValueSeparation allows disabling the value separation, all
+	// values are then stored inline in the 'sorted table' along with their
+	// keys, as in classic LevelDB. Values separated before remain in the
+	// value log and are still read and garbage collected from there.
+	//
+	// The default is false.
+	DisableValueSeparation bool
+
 	// ErrorIfExist defines whether an error should returned if the DB already
 	// exist.
 	//
@@ -345,7 +398,8 @@ type Options struct {
 	// The default value is 500.
 	OpenFilesCacheCapacity int
 
-	// If true then opens DB in read-only mode.
+	// If true then opens DB in read-only mode, the value log included; no
+	// file of the DB is written to.
 	//
 	// The default value is false.
 	ReadOnly bool
@@ -353,6 +407,84 @@ type Options struct {
 	// Strict defines the DB strict level.
 	Strict Strict
 
+	// ValueLogCacheCapacity defines the capacity of the value caching, which
+	// keeps recently read values of the value log in memory. Values stored
+	// inline are cached along with their 'sorted table' block instead.
+	//
+	// The default value is 0, which disables the value caching.
+	ValueLogCacheCapacity int
+
+	// ValueLogFileSize limits the size of a single value log file; a value
+	// log file is closed and a new one started once it reaches that size.
+	//
+	// The default value is 512MiB.
+	ValueLogFileSize int
+
+	// ValueLogGCPaused defines whether the background value log garbage
+	// collection starts out paused, see DB.ResumeValueLogGC. A paused
+	// value log is only collected by DB.CompactValueLog.
+	//
+	// The default value is false.
+	ValueLogGCPaused bool
+
+	// ValueLogGCRateLimit limits the I/O of the value log garbage
+	// collection, reads and writes combined, in bytes per second.
+	//
+	// The default value is 0, which does not limit the I/O.
+	ValueLogGCRateLimit int
+
+	// ValueLogGCTargetRatio defines the fraction of ValueLogMaxSize that a
+	// value log garbage collection shrinks the value log down to.
+	//
+	// The default value is 0.6.
+	ValueLogGCTargetRatio float64
+
+	// ValueLogGCTriggerRatio defines the fraction of ValueLogMaxSize that
+	// triggers a value log garbage collection.
+	//
+	// The default value is 0.8.
+	ValueLogGCTriggerRatio float64
+
+	// ValueLogMaxSize defines the size budget of the value log, garbage
+	// collection is triggered and targeted relative to it. See
+	// ValueLogGCTriggerRatio and ValueLogGCTargetRatio.
+	//
+	// The default value is 16GiB.
+	ValueLogMaxSize int64
+
+	// ValueLogFilesCacheCapacity defines the capacity of the open value
+	// log files caching.
+	// Use -1 for zero, this disables caching and every value read opens
+	// its value log file anew.
+	//
+	// The default value is 100.
+	ValueLogFilesCacheCapacity int
+
+	// ValueStorage defines the storage the value log is kept in, e.g. one
+	// on a separate disk. It is not locked nor closed by the DB, that is
+	// up to the caller.
+	//
+	// The default value is nil, which keeps the value log in the storage of
+	// the DB itself.
+	ValueStorage storage.Storage
+
+	// ValueSeparation defines the policy deciding which values are
+	// separated into the value log, e.g. by key prefix with
+	// PrefixSeparation. Values whose key exceeds 16MiB are always stored
+	// inline. See WriteOptions.Sync on the durability of separated values.
+	//
+	// The default value is nil, which separates by ValueThreshold.
+	ValueSeparation ValueSeparation
+
+	// ValueThreshold defines the minimum size of a value to be separated
+	// into the value log. Smaller values are stored inline in the 'sorted
+	// table' along with their keys.
+	// Use -1 for zero, this separates all values.
+	// ValueThreshold has no effect if ValueSeparation is set.
+	//
+	// The default value is 64.
+	ValueThreshold int
+
 	// WriteBuffer defines maximum size of a 'memdb' before flushed to
 	// 'sorted table'. 'memdb' is an in-memory DB backed by an on-disk
 	// unsorted journal.
@@ -543,6 +675,13 @@ func (o *Options) GetDisableSeeksCompaction() bool {
 	return o.DisableSeeksCompaction
 }
 
+func (o *Options) GetDisableValueSeparation() bool {
+	if o == nil {
+		return false
+	}
+	return o.DisableValueSeparation
+}
+
 func (o *Options) GetErrorIfExist() bool {
 	if o == nil {
 		return false
@@ -620,6 +759,87 @@ func (o *Options) GetStrict(strict Strict) bool {
 	return o.Strict&strict != 0
 }
 
+func (o *Options) GetValueLogCacheCapacity() int {
+	if o == nil || o.ValueLogCacheCapacity <= 0 {
+		return 0
+	}
+	return o.ValueLogCacheCapacity
+}
+
+func (o *Options) GetValueLogFileSize() int {
+	if o == nil || o.ValueLogFileSize <= 0 {
+		return DefaultValueLogFileSize
+	}
+	return o.ValueLogFileSize
+}
+
+func (o *Options) GetValueLogGCPaused() bool {
+	if o == nil {
+		return false
+	}
+	return o.ValueLogGCPaused
+}
+
+func (o *Options) GetValueLogGCRateLimit() int {
+	if o == nil || o.ValueLogGCRateLimit <= 0 {
+		return 0
+	}
+	return o.ValueLogGCRateLimit
+}
+
+func (o *Options) GetValueLogGCTargetRatio() float64 {
+	if o == nil || o.ValueLogGCTargetRatio <= 0 || o.ValueLogGCTargetRatio >= 1 {
+		return DefaultValueLogGCTargetRatio
+	}
+	return o.ValueLogGCTargetRatio
+}
+
+func (o *Options) GetValueLogGCTriggerRatio() float64 {
+	if o == nil || o.ValueLogGCTriggerRatio <= 0 || o.ValueLogGCTriggerRatio > 1 {
+		return DefaultValueLogGCTriggerRatio
+	}
+	return o.ValueLogGCTriggerRatio
+}
+
+func (o *Options) GetValueLogMaxSize() int64 {
+	if o == nil || o.ValueLogMaxSize <= 0 {
+		return DefaultValueLogMaxSize
+	}
+	return o.ValueLogMaxSize
+}
+
+func (o *Options) GetValueLogFilesCacheCapacity() int {
+	if o == nil || o.ValueLogFilesCacheCapacity == 0 {
+		return DefaultValueLogFilesCacheCapacity
+	} else if o.ValueLogFilesCacheCapacity < 0 {
+		return 0
+	}
+	return o.ValueLogFilesCacheCapacity
+}
+
+func (o *Options) GetValueSeparation() ValueSeparation {
+	if o == nil || o.ValueSeparation == nil {
+		return ThresholdSeparation(o.GetValueThreshold())
+	}
+	return o.ValueSeparation
+}
+
+func (o *Options) GetValueStorage() storage.Storage {
+	if o == nil {
+		return nil
+	}
+	return o.ValueStorage
+}
+
+func (o *Options) GetValueThreshold() int {
+	if o == nil || o.ValueThreshold == 0 {
+		return DefaultValueThreshold
+	} else if o.ValueThreshold < 0 {
+		return 0
+	}
+	return o.ValueThreshold
+}
+
 func (o *Options) GetWriteBuffer() int {
 	if o == nil || o.WriteBuffer <= 0 {
 		return DefaultWriteBuffer
@@ -654,6 +874,13 @@ type ReadOptions struct {
 	// Strict will be OR'ed with global DB 'strict level' unless StrictOverride
 	// is present. Currently only StrictReader that has effect here.
 	Strict Strict
+
+	// ValuePrefetch defines the number of values an iterator reads ahead
+	// from the value log, in parallel, while it moves forward. Only takes
+	// effect on iterators.
+	//
+	// The default value is 0, which disables prefetching.
+	ValuePrefetch int
 }
 
 func (ro *ReadOptions) GetDontFillCache() bool {
@@ -670,6 +897,13 @@ func (ro *ReadOptions) GetStrict(strict Strict) bool {
 	return ro.Strict&strict != 0
 }
 
+func (ro *ReadOptions) GetValuePrefetch() int {
+	if ro == nil || ro.ValuePrefetch < 0 {
+		return 0
+	}
+	return ro.ValuePrefetch
+}
+
 // WriteOptions holds the optional parameters for 'write operation'. The
 // 'write operation' includes Write, Put and Delete.
 type WriteOptions struct {
@@ -689,6 +923,13 @@ type WriteOptions struct {
 	// In other words, Sync being false has the same semantics as a write
 	// system call. Sync being true means write followed by fsync.
 	//
+	// The separated values of a write are written to the value log before
+	// the journal record referring to them, but if Sync is false neither
+	// is synced. So after a machine crash the journal may keep the
+	// locations of values lost from the tail of the value log; reading
+	// such a key returns an errors.ErrCorrupted, and DB.VerifyValueLog
+	// reports it.
+	//
 	// The default value is false.
 	Sync bool
 }
@@ -70,7 +70,7 @@ type session struct {
 }
 
 // Creates new initialized session instance.
-func newSession(stor storage.Storage, vStore *vStorage, o *opt.Options) (s *session, err error) {
+func newSession(stor storage.Storage, o *opt.Options) (s *session, err error) {
 	if stor == nil {
 		return nil, os.ErrInvalid
 	}
@@ -80,7 +80,6 @@ func newSession(stor storage.Storage, vStore *vStorage, o *opt.Options) (s *sess
 	}
 	s = &session{
 		stor:      newIStorage(stor),
-		vStore: vStore,
 		storLock:  storLock,
 		refCh:     make(chan *vTask),
 		relCh:     make(chan *vTask),
@@ -134,7 +133,9 @@ func (s *session) recover() (err error) {
 		if os.IsNotExist(err) {
 			// Don't return os.ErrNotExist if the underlying storage contains
 			// other files that belong to LevelDB. So the DB won't get trashed.
-			if fds, _ := s.stor.List(storage.TypeAll); len(fds) > 0 {
+			// The value log files don't count, they are of no use without
+			// the manifest.
+			if fds, _ := s.stor.List(storage.TypeAll &^ (storage.TypeValue | storage.TypeValueManifest)); len(fds) > 0 {
 				err = &errors.ErrCorrupted{Fd: storage.FileDesc{Type: storage.TypeManifest}, Err: &errors.ErrMissingFiles{}}
 			}
 		}
@@ -585,7 +585,7 @@ func (fw *fileWrap) Sync() error {
 	if err := fw.File.Sync(); err != nil {
 		return err
 	}
-	if fw.fd.Type == TypeManifest {
+	if fw.fd.Type == TypeManifest || fw.fd.Type == TypeValueManifest {
 		// Also sync parent directory if file type is manifest.
 		// See: https://code.google.com/p/leveldb/issues/detail?id=190.
 		if err := syncDir(fw.fs.path); err != nil {
@@ -621,19 +621,26 @@ func fsGenName(fd FileDesc) string {
 		return fmt.Sprintf("%06d.ldb", fd.Num)
 	case TypeTemp:
 		return fmt.Sprintf("%06d.tmp", fd.Num)
+	case TypeValue:
+		return fmt.Sprintf("level_%d_number_%d.value", fd.Num>>32, fd.Num&0xffffffff)
+	case TypeValueManifest:
+		return fmt.Sprintf("VMANIFEST-%06d", fd.Num)
 	default:
 		panic("invalid file type")
 	}
 }
 
 func fsHasOldName(fd FileDesc) bool {
-	return fd.Type == TypeTable
+	// The value log used to have a single manifest.
+	return fd.Type == TypeTable || (fd.Type == TypeValueManifest && fd.Num == 0)
 }
 
 func fsGenOldName(fd FileDesc) string {
 	switch fd.Type {
 	case TypeTable:
 		return fmt.Sprintf("%06d.sst", fd.Num)
+	case TypeValueManifest:
+		return "Manifest"
 	}
 	return fsGenName(fd)
 }
@@ -659,7 +666,20 @@ func fsParseName(name string) (fd FileDesc, ok bool) {
 		fd.Type = TypeManifest
 		return fd, true
 	}
-	return
+	n, _ = fmt.Sscanf(name, "VMANIFEST-%d%s", &fd.Num, &tail)
+	if n == 1 && fd.Num >= 0 {
+		fd.Type = TypeValueManifest
+		return fd, true
+	}
+	if name == "Manifest" {
+		return FileDesc{TypeValueManifest, 0}, true
+	}
+	var level, num int64
+	n, _ = fmt.Sscanf(name, "level_%d_number_%d.%s", &level, &num, &tail)
+	if n == 3 && tail == "value" && level >= 0 && level < 1<<31 && num >= 0 && num <= 0xffffffff {
+		return FileDesc{TypeValue, level<<32 | num}, true
+	}
+	return FileDesc{}, false
 }
 
 func fsParseNamePtr(name string, fd *FileDesc) bool {
@@ -29,6 +29,10 @@ var cases = []struct {
 	{nil, "MANIFEST-000007", TypeManifest, 7},
 	{nil, "9223372036854775807.log", TypeJournal, 9223372036854775807},
 	{nil, "000100.tmp", TypeTemp, 100},
+	{nil, "level_0_number_3.value", TypeValue, 3},
+	{nil, "level_2_number_7.value", TypeValue, 2<<32 | 7},
+	{[]string{"Manifest"}, "VMANIFEST-000000", TypeValueManifest, 0},
+	{nil, "VMANIFEST-000004", TypeValueManifest, 4},
 }
 
 var invalidCases = []string{
@@ -54,6 +58,12 @@ var invalidCases = []string{
 	"100",
 	"100.",
 	"100.lop",
+	"level_1_number_2",
+	"level_1_number_2.valuex",
+	"level_-1_number_2.value",
+	"level_1_number_4294967296.value",
+	"VMANIFEST-",
+	"Manifest.tmp",
 }
 
 func tempDir(t *testing.T) string {
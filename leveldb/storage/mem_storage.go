@@ -8,11 +8,13 @@ package storage
 
 import (
 	"bytes"
+	"errors"
+	"io"
 	"os"
 	"sync"
 )
 
-const typeShift = 4
+const typeShift = 6
 
 // Verify at compile-time that typeShift is large enough to cover all FileType
 // values by confirming that 0 == 0.
@@ -100,6 +102,9 @@ func (ms *memStorage) Open(fd FileDesc) (Reader, error) {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
 	if m, exist := ms.files[packFile(fd)]; exist {
+		if fd.Type == TypeValue {
+			return &memValueReader{ms: ms, m: m}, nil
+		}
 		if m.open {
 			return nil, errFileOpen
 		}
@@ -201,6 +206,12 @@ type memWriter struct {
 	closed bool
 }
 
+func (mw *memWriter) Write(p []byte) (int, error) {
+	mw.ms.mu.Lock()
+	defer mw.ms.mu.Unlock()
+	return mw.memFile.Write(p)
+}
+
 func (*memWriter) Sync() error { return nil }
 
 func (mw *memWriter) Close() error {
@@ -213,6 +224,67 @@ func (mw *memWriter) Close() error {
 	return nil
 }
 
+// memValueReader reads a value file, seeing the data written to it after it
+// was opened.
+type memValueReader struct {
+	ms     *memStorage
+	m      *memFile
+	pos    int64
+	closed bool
+}
+
+func (mr *memValueReader) Read(p []byte) (n int, err error) {
+	n, err = mr.ReadAt(p, mr.pos)
+	mr.pos += int64(n)
+	return
+}
+
+func (mr *memValueReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("leveldb/storage: negative offset")
+	}
+	mr.ms.mu.Lock()
+	defer mr.ms.mu.Unlock()
+	b := mr.m.Bytes()
+	if off >= int64(len(b)) {
+		return 0, io.EOF
+	}
+	n = copy(p, b[off:])
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+func (mr *memValueReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += mr.pos
+	case io.SeekEnd:
+		mr.ms.mu.Lock()
+		offset += int64(mr.m.Len())
+		mr.ms.mu.Unlock()
+	default:
+		return 0, errors.New("leveldb/storage: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("leveldb/storage: negative position")
+	}
+	mr.pos = offset
+	return offset, nil
+}
+
+func (mr *memValueReader) Close() error {
+	mr.ms.mu.Lock()
+	defer mr.ms.mu.Unlock()
+	if mr.closed {
+		return ErrClosed
+	}
+	mr.closed = true
+	return nil
+}
+
 func packFile(fd FileDesc) uint64 {
 	return uint64(fd.Num)<<typeShift | uint64(fd.Type)
 }
@@ -115,3 +115,39 @@ func TestMemStorageRename(t *testing.T) {
 		}
 	}
 }
+
+func TestMemStorageValueFile(t *testing.T) {
+	fd := FileDesc{Type: TypeValue, Num: 1<<32 | 5}
+
+	m := NewMemStorage()
+	w, err := m.Create(fd)
+	if err != nil {
+		t.Fatalf("Storage.Create: %v", err)
+	}
+	fmt.Fprintf(w, "abc")
+	r1, err := m.Open(fd)
+	if err != nil {
+		t.Fatalf("Open: got error: %v", err)
+	}
+	r2, err := m.Open(fd)
+	if err != nil {
+		t.Fatalf("Open: got error: %v", err)
+	}
+	fmt.Fprintf(w, "def")
+	w.Close()
+
+	buf := make([]byte, 3)
+	if _, err := r1.ReadAt(buf, 3); err != nil || string(buf) != "def" {
+		t.Fatalf("ReadAt: got %q, %v, want=def", buf, err)
+	}
+	if err := m.Remove(fd); err != nil {
+		t.Fatalf("Remove: got error: %v", err)
+	}
+	all := new(bytes.Buffer)
+	all.ReadFrom(r2)
+	if got := all.String(); got != "abcdef" {
+		t.Fatalf("Read: invalid value, want=abcdef got=%s", got)
+	}
+	r1.Close()
+	r2.Close()
+}
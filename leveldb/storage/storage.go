@@ -22,10 +22,20 @@ const (
 	TypeJournal
 	TypeTable
 	TypeTemp
+	TypeValue
+	TypeValueManifest
 
-	TypeAll = TypeManifest | TypeJournal | TypeTable | TypeTemp
+	TypeAll = TypeManifest | TypeJournal | TypeTable | TypeTemp | TypeValue | TypeValueManifest
 )
 
+// Value log files are numbered by value log level and file number within
+// the level, the level being kept in the upper 32 bits of the number.
+//
+// Unlike other files, value files are read while still being written to: a
+// value file may be opened any number of times, also while it is open for
+// writing, and its readers see the data written after they were opened.
+// They may also be removed while still open for reading.
+
 func (t FileType) String() string {
 	switch t {
 	case TypeManifest:
@@ -36,6 +46,10 @@ func (t FileType) String() string {
 		return "table"
 	case TypeTemp:
 		return "temp"
+	case TypeValue:
+		return "value"
+	case TypeValueManifest:
+		return "value-manifest"
 	}
 	return fmt.Sprintf("<unknown:%d>", t)
 }
@@ -112,6 +126,10 @@ func (fd FileDesc) String() string {
 		return fmt.Sprintf("%06d.ldb", fd.Num)
 	case TypeTemp:
 		return fmt.Sprintf("%06d.tmp", fd.Num)
+	case TypeValue:
+		return fmt.Sprintf("level_%d_number_%d.value", fd.Num>>32, fd.Num&0xffffffff)
+	case TypeValueManifest:
+		return fmt.Sprintf("VMANIFEST-%06d", fd.Num)
 	default:
 		return fmt.Sprintf("%#x-%d", fd.Type, fd.Num)
 	}
@@ -129,6 +147,8 @@ func FileDescOk(fd FileDesc) bool {
 	case TypeJournal:
 	case TypeTable:
 	case TypeTemp:
+	case TypeValue:
+	case TypeValueManifest:
 	default:
 		return false
 	}
@@ -60,6 +60,8 @@ const (
 	typeJournal
 	typeTable
 	typeTemp
+	typeValue
+	typeValueManifest
 
 	typeCount
 )
@@ -98,6 +100,10 @@ func flattenType(m StorageMode, t storage.FileType) int {
 		return x + typeTable
 	case storage.TypeTemp:
 		return x + typeTemp
+	case storage.TypeValue:
+		return x + typeValue
+	case storage.TypeValueManifest:
+		return x + typeValueManifest
 	default:
 		panic("invalid file type")
 	}
@@ -116,6 +122,10 @@ func listFlattenType(m StorageMode, t storage.FileType) []int {
 			ret = append(ret, x+typeTable)
 		case t&storage.TypeTemp != 0:
 			ret = append(ret, x+typeTemp)
+		case t&storage.TypeValue != 0:
+			ret = append(ret, x+typeValue)
+		case t&storage.TypeValueManifest != 0:
+			ret = append(ret, x+typeValueManifest)
 		}
 	}
 	switch {
@@ -204,7 +214,7 @@ func (r *reader) ReadAt(p []byte, off int64) (n int, err error) {
 }
 
 func (r *reader) Close() (err error) {
-	return r.s.fileClose(r.fd, r.Reader)
+	return r.s.fileClose(r.fd, r.Reader, false)
 }
 
 type writer struct {
@@ -240,7 +250,7 @@ func (w *writer) Sync() (err error) {
 }
 
 func (w *writer) Close() (err error) {
-	return w.s.fileClose(w.fd, w.Writer)
+	return w.s.fileClose(w.fd, w.Writer, true)
 }
 
 type Storage struct {
@@ -255,7 +265,10 @@ type Storage struct {
 	mu   sync.Mutex
 	rand *rand.Rand
 	// Open files, true=writer, false=reader
-	opens                   map[uint64]bool
+	opens map[uint64]bool
+	// Value files may have any number of readers, also while open for
+	// writing or removed; their readers are counted apart.
+	valueReaders            map[uint64]int
 	counters                [flattenCount]int
 	bytesCounter            [flattenCount]int64
 	emulatedError           [flattenCount]error
@@ -378,25 +391,33 @@ func (s *Storage) SetMeta(fd storage.FileDesc) error {
 	return err
 }
 
-func (s *Storage) fileClose(fd storage.FileDesc, closer io.Closer) (err error) {
+func (s *Storage) fileClose(fd storage.FileDesc, closer io.Closer, writer bool) (err error) {
 	err = s.emulateError(ModeClose, fd.Type)
 	if err == nil {
 		s.stall(ModeClose, fd.Type)
 	}
 	x := packFile(fd)
+	valueReader := fd.Type == storage.TypeValue && !writer
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if err == nil {
-		ExpectWithOffset(2, s.opens).To(HaveKey(x), "File closed, fd=%s", fd)
+		if valueReader {
+			ExpectWithOffset(2, s.valueReaders).To(HaveKey(x), "File closed, fd=%s", fd)
+		} else {
+			ExpectWithOffset(2, s.opens).To(HaveKey(x), "File closed, fd=%s", fd)
+		}
 		err = closer.Close()
 	}
 	s.countNB(ModeClose, fd.Type, 0)
-	writer := s.opens[x]
 	if err != nil {
 		s.logISkip(1, "file close failed, fd=%s writer=%v err=%v", fd, writer, err)
 	} else {
 		s.logISkip(1, "file closed, fd=%s writer=%v", fd, writer)
-		delete(s.opens, x)
+		if !valueReader {
+			delete(s.opens, x)
+		} else if s.valueReaders[x]--; s.valueReaders[x] == 0 {
+			delete(s.valueReaders, x)
+		}
 	}
 	return
 }
@@ -414,7 +435,9 @@ func (s *Storage) Open(fd storage.FileDesc) (r storage.Reader, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if err == nil {
-		s.assertOpen(fd)
+		if fd.Type != storage.TypeValue {
+			s.assertOpen(fd)
+		}
 		s.countNB(ModeOpen, fd.Type, 0)
 		r, err = s.Storage.Open(fd)
 	}
@@ -422,7 +445,11 @@ func (s *Storage) Open(fd storage.FileDesc) (r storage.Reader, err error) {
 		s.logI("file open failed, fd=%s err=%v", fd, err)
 	} else {
 		s.logI("file opened, fd=%s", fd)
-		s.opens[packFile(fd)] = false
+		if fd.Type == storage.TypeValue {
+			s.valueReaders[packFile(fd)]++
+		} else {
+			s.opens[packFile(fd)] = false
+		}
 		r = &reader{s, fd, r}
 	}
 	return
@@ -517,6 +544,10 @@ func (s *Storage) openFiles() string {
 		fd := unpackFile(x)
 		out += fmt.Sprintf("\n · fd=%s writer=%v", fd, writer)
 	}
+	for x, n := range s.valueReaders {
+		fd := unpackFile(x)
+		out += fmt.Sprintf("\n · fd=%s readers=%d", fd, n)
+	}
 	return out
 }
 
@@ -524,6 +555,7 @@ func (s *Storage) CloseCheck() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	ExpectWithOffset(1, s.opens).To(BeEmpty(), s.openFiles())
+	ExpectWithOffset(1, s.valueReaders).To(BeEmpty(), s.openFiles())
 }
 
 func (s *Storage) OnClose(onClose func() (preserve bool, err error)) {
@@ -536,6 +568,7 @@ func (s *Storage) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	ExpectWithOffset(1, s.opens).To(BeEmpty(), s.openFiles())
+	ExpectWithOffset(1, s.valueReaders).To(BeEmpty(), s.openFiles())
 	err := s.Storage.Close()
 	if err != nil {
 		s.logI("storage closing failed, err=%v", err)
@@ -575,6 +608,8 @@ func (s *Storage) count(m StorageMode, t storage.FileType, n int) {
 }
 
 func (s *Storage) ResetCounter(m StorageMode, t storage.FileType) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	for _, x := range listFlattenType(m, t) {
 		s.counters[x] = 0
 		s.bytesCounter[x] = 0
@@ -582,6 +617,8 @@ func (s *Storage) ResetCounter(m StorageMode, t storage.FileType) {
 }
 
 func (s *Storage) Counter(m StorageMode, t storage.FileType) (count int, bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	for _, x := range listFlattenType(m, t) {
 		count += s.counters[x]
 		bytes += s.bytesCounter[x]
@@ -680,10 +717,11 @@ func NewStorage() *Storage {
 		stor = storage.NewMemStorage()
 	}
 	s := &Storage{
-		Storage: stor,
-		path:    path,
-		rand:    NewRand(),
-		opens:   make(map[uint64]bool),
+		Storage:      stor,
+		path:         path,
+		rand:         NewRand(),
+		opens:        make(map[uint64]bool),
+		valueReaders: make(map[uint64]int),
 	}
 	s.stallCond.L = &s.mu
 	if s.path != "" {
@@ -2,296 +2,2166 @@ package leveldb
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
-	"github.com/ccfarm/fasterleveldb/dbutil"
 	"io"
+	"math"
 	"os"
-	"path"
-	"strconv"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"github.com/ccfarm/goleveldb/leveldb/cache"
+	"github.com/ccfarm/goleveldb/leveldb/errors"
+	"github.com/ccfarm/goleveldb/leveldb/journal"
+	"github.com/ccfarm/goleveldb/leveldb/opt"
+	"github.com/ccfarm/goleveldb/leveldb/storage"
+	"github.com/ccfarm/goleveldb/leveldb/util"
+	"github.com/golang/snappy"
 )
 
 const (
-	Capacity     = 512 * 1024 * 1024
 	Manifest     = "Manifest"
 	LEVEL        = 64
-	ManifestSize = LEVEL * 3 * 4 + 20
-	MaxSize      = 16 * 1024 * 1024 * 1024
-	WarningLine  = MaxSize / 10 * 8
-	SafeLine     = MaxSize / 10 * 6
+	ManifestSize = LEVEL*3*4 + 20
+)
+
+// A value record is laid out as:
+//
+//	checksum  uint32, masked CRC-32 of the rest of the record
+//	length    uint32, length of the whole record, header included
+//	type      byte, compression of the value, or'ed with vRecordSeq64
+//	keyLen    uint24
+//	valueLen  uint32, length of the value as stored
+//	seq       uint64
+//	key       [keyLen]byte
+//	value     [valueLen]byte
+//
+// All integers are big-endian. Records written before sequence numbers were
+// widened lack vRecordSeq64 and have a uint32 seq, their header is
+// vRecordHeaderLen long.
+const (
+	vRecordHeaderLen   = 20
+	vRecordHeaderLen64 = 24
+)
+
+// vRecordSeq64 flags, in the type byte, a record with a uint64 seq.
+const vRecordSeq64 = 0x80
+
+// Compression types of a value record.
+const (
+	vRecordNoCompression     = 0
+	vRecordSnappyCompression = 1
 )
 
+// vRecordMaxKeyLen is the maximum key length of a value record; values of
+// longer keys are stored inline.
+const vRecordMaxKeyLen = 1<<24 - 1
+
+// vBufferPoolBaseline is the baseline size of the buffers records are read
+// into.
+const vBufferPoolBaseline = 4 * opt.KiB
+
+// A value stored in the LSM is tagged by its first byte: either the value
+// itself follows (inline), or a value log location does. A location is laid
+// out as:
+//
+//	tag         byte, valueTagVarPointer
+//	length      uvarint, length of the record
+//	level       uvarint
+//	fileNumber  uvarint
+//	offset      uvarint
+//	seq         uvarint
+//
+// Locations written before sequence numbers were widened point to records
+// without vRecordSeq64 and are laid out as:
+//
+//	tag         byte, valueTagPointer
+//	length      uint32, length of the record
+//	fileNumber  uint32
+//	offset      uint32
+//	seq         uint32
+//	level       uint32
+//
+// All fixed-size integers are big-endian. A record is always pointed to in
+// the layout matching its own, see recordLocation.
+const (
+	valueTagInline     byte = 0
+	valueTagPointer    byte = 1
+	valueTagVarPointer byte = 2
+)
+
+// locationLen is the length of a location tagged valueTagPointer, tag
+// included.
+const locationLen = 21
+
+// ErrValueCorrupted records value log corruption. This error will be
+// wrapped with errors.ErrCorrupted.
+type ErrValueCorrupted struct {
+	Level      int
+	FileNumber int
+	Offset     int
+	Reason     string
+}
+
+func (e *ErrValueCorrupted) Error() string {
+	return fmt.Sprintf("leveldb: value log corrupted (level=%d file=%d offset=%d): %s", e.Level, e.FileNumber, e.Offset, e.Reason)
+}
+
+// newErrValueCorrupted returns a value log corruption error, a negative level
+// or file number if the file is unknown.
+func newErrValueCorrupted(level, fileNumber, offset int, reason string) error {
+	var fd storage.FileDesc
+	if level >= 0 && fileNumber >= 0 {
+		fd = valueFileDesc(level, fileNumber)
+	}
+	return errors.NewErrCorrupted(fd, &ErrValueCorrupted{level, fileNumber, offset, reason})
+}
+
 type Level struct {
-	Start int
-	End int
+	Start  int
+	End    int
 	Offset int
 }
 
+// obsoleteFile is a compacted value file waiting to be removed. Seq is the
+// DB sequence number right after the live records of the file have been
+// relocated; readers older than that may still read from the file. Every
+// reader (snapshot, iterator or in-flight Get) holds a DB snapshot element,
+// so the file is removed once db.minSeq reaches Seq, much like a table file
+// is removed once no version refers to it.
+type obsoleteFile struct {
+	File fileKey
+	Seq  uint64
+}
+
+type fileKey struct {
+	Level  int
+	Number int
+}
+
+// fileStat accounts the bytes of a value file. A record becomes dead once
+// the LSM entry referring to it is dropped by table compaction, that is
+// once its key has been overwritten or deleted and no snapshot can see the
+// old entry anymore.
+type fileStat struct {
+	Size int64
+	Dead int64
+}
+
 type vStorage struct {
-	Path              string
+	Stor              storage.Storage
 	Size              int64
 	CurrentFileNumber int
-	CurrentFile       *os.File
+	CurrentFile       storage.Writer
 	Offset            int
-	Sequence          int
+	Sequence          uint64
 	Mutex             *sync.Mutex
 	Level             []Level
-	Compacting        bool
 	KeyStore          *DB
+	Obsolete          []obsoleteFile
+	obsoleteN         int32 // Length of Obsolete, accessed atomically.
+
+	// Files holds the live and dead byte counts of each value file. Dead
+	// is the sum of the dead bytes, it is accessed atomically but only
+	// changed under the mutex, like Size. The dead bytes are unknown if
+	// Recount is set, see recount.
+	Files   map[fileKey]*fileStat
+	Dead    int64
+	Recount bool
+
+	// Limits derived from the options, see opt.Options.
+	FileSize    int
+	WarningLine int64               // Size that triggers compaction.
+	SafeLine    int64               // Size compaction shrinks the value log down to.
+	Separation  opt.ValueSeparation // All values are stored inline if nil.
+	Compression opt.Compression
+
+	// Value files opened for reading are cached by level and number, the
+	// records are read into buffers from the pool.
+	fcache *cache.Cache
+	bpool  *util.BufferPool
+
+	// Values read are cached by file and offset if vcache is not nil, see
+	// valueCacheNS. The hits and misses are accessed atomically.
+	vcache     *cache.Cache
+	vcacheHit  uint64
+	vcacheMiss uint64
+
+	// Statistics, accessed atomically, see valueLogStats.
+	gcRuns      uint32
+	gcRelocated int64
+	gcReclaimed int64
+	gcDuration  int64
+	ioRead      uint64
+	ioWrite     uint64
+
+	// gcSem is held while a compaction runs. Background compaction is
+	// paused while gcPaused is set, it is accessed atomically.
+	gcSem    chan struct{}
+	gcPaused int32
+	gcRate   int // Compaction I/O limit in bytes per second, or 0.
+
+	// Torn is set once a write to the current file failed; the file may
+	// hold part of the records then, so the next write starts a new file.
+	Torn bool
+
+	// ReadOnly is set if the value log is opened read-only, it then never
+	// writes to the storage: there is neither a current file nor a manifest
+	// of its own, and compaction is off.
+	ReadOnly bool
+
+	// CompactFiles are the output files of compaction by level. They are
+	// kept open until Close, see compactFile.
+	CompactFiles map[int]storage.Writer
+
+	// The value log manifest is a journal of state records, a new record
+	// is appended whenever the set of value files changes. A new manifest
+	// is started on every open.
+	ManifestFile   storage.Writer
+	ManifestWriter *journal.Writer
+	ManifestNumber int64
+
+	// closer is closed along with the value log, if not nil.
+	closer io.Closer
 }
 
-func OpenStore(valuePath string) *vStorage {
-	manifestPath := path.Join(valuePath, Manifest)
-	if dbutil.FileExists(manifestPath) {
-		return loadStore(valuePath)
-	} else {
-		return newStore(valuePath)
-	}
-}
-
-func loadStore(valuePath string) *vStorage {
-	manifestPath := path.Join(valuePath, Manifest)
-	manifestFile, _ := os.OpenFile(manifestPath, os.O_RDONLY, os.ModePerm)
-	bufferSize := ManifestSize
-	buffer := make([]byte, bufferSize)
-	reader := bufio.NewReader(manifestFile)
-	io.ReadFull(reader, buffer)
-	manifestFile.Close()
-	//manifestFile.Read(buffer)
-	sequence := int(binary.BigEndian.Uint32(buffer[0:]))
-	size := binary.BigEndian.Uint64(buffer[4:])
-	currentFileNumber := int(binary.BigEndian.Uint32(buffer[12:]))
-	offset := int(binary.BigEndian.Uint32(buffer[16:]))
+// openStore opens or creates the value log in the given storage. The value
+// log state is read from the manifest and reconciled with the value files,
+// so records appended after the last manifest record are recovered. If
+// rebuild is set the manifest is ignored; the value log state is rebuilt by
+// scanning all value files instead.
+//
+// The value log does not lock the storage, which may be shared with the DB
+// as its files have types of their own.
+func openStore(stor storage.Storage, o *opt.Options, rebuild bool) (*vStorage, error) {
+	maxSize := float64(o.GetValueLogMaxSize())
 	vs := &vStorage{
-		Path:              valuePath,
-		Size:              int64(size),
-		CurrentFileNumber: currentFileNumber,
-		Offset:            offset,
-		Sequence:          sequence,
-		Mutex:             &sync.Mutex{},
-		Level:make([]Level, LEVEL),
-	}
-	filename := vs.generateFilename(0, vs.CurrentFileNumber)
-	vs.CurrentFile, _ = os.OpenFile(filename, os.O_CREATE | os.O_RDWR, os.ModePerm)
-	for i := 0; i < LEVEL; i++ {
-		vs.Level[i].Start = int(binary.BigEndian.Uint32(buffer[20 + i * 12:]))
-		vs.Level[i].End = int(binary.BigEndian.Uint32(buffer[20 + i * 12 + 4:]))
-		vs.Level[i].Offset = int(binary.BigEndian.Uint32(buffer[20 + i * 12 + 8:]))
+		Stor:        stor,
+		Mutex:       &sync.Mutex{},
+		Level:       make([]Level, LEVEL),
+		FileSize:    o.GetValueLogFileSize(),
+		WarningLine: int64(maxSize * o.GetValueLogGCTriggerRatio()),
+		SafeLine:    int64(maxSize * o.GetValueLogGCTargetRatio()),
+		Compression: o.GetCompression(),
+		gcSem:       make(chan struct{}, 1),
+		gcRate:      o.GetValueLogGCRateLimit(),
+		Files:       make(map[fileKey]*fileStat),
+
+		CompactFiles: make(map[int]storage.Writer),
+		ReadOnly:     o.GetReadOnly(),
+	}
+	if !o.GetDisableValueSeparation() {
+		vs.Separation = o.GetValueSeparation()
+	}
+	if o.GetValueLogGCPaused() {
+		vs.gcPaused = 1
+	}
+	if err := vs.recover(rebuild); err != nil {
+		return nil, err
+	}
+	if !vs.ReadOnly {
+		f, err := vs.createFile(0)
+		if err != nil {
+			return nil, err
+		}
+		vs.CurrentFile = f
+		if err := vs.createManifest(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	var cacher cache.Cacher
+	if o.GetValueLogFilesCacheCapacity() > 0 {
+		cacher = cache.NewLRU(o.GetValueLogFilesCacheCapacity())
 	}
-	return vs
+	vs.fcache = cache.NewCache(cacher)
+	if o.GetValueLogCacheCapacity() > 0 {
+		vs.vcache = cache.NewCache(cache.NewLRU(o.GetValueLogCacheCapacity()))
+	}
+	if !o.GetDisableBufferPool() {
+		vs.bpool = util.NewBufferPool(vBufferPoolBaseline)
+	}
+	return vs, nil
 }
 
-func newStore(valuePath string) *vStorage {
-	vs := &vStorage{
-		Path:              valuePath,
-		Size:              1,
-		CurrentFileNumber: 0,
-		Offset:            0,
-		Sequence:          0,
-		Mutex:             &sync.Mutex{},
-		Level:make([]Level, LEVEL),
-	}
-	os.MkdirAll(valuePath, os.ModePerm)
-	filename := vs.generateFilename(0, vs.CurrentFileNumber)
-	vs.CurrentFile, _ = os.OpenFile(filename, os.O_CREATE | os.O_RDWR, os.ModePerm)
-	//fmt.Println(filename)
-	return vs
-}
-
-func (vs *vStorage)Put(key []byte, value []byte) (location []byte) {
-	l := len(key) + len(value) + 16
-	buffer := make([]byte, l)
-	binary.BigEndian.PutUint32(buffer[0: ], uint32(l))
-	binary.BigEndian.PutUint32(buffer[4: ], uint32(len(key)))
-	binary.BigEndian.PutUint32(buffer[8: ], uint32(len(value)))
-	copy(buffer[16: ], key)
-	copy(buffer[len(key) + 16: ], value)
+// recover rebuilds the value log state. The last manifest record is taken
+// as the starting point if there is one; it is then brought up to date by
+// scanning the value files, which also rebuilds the state from scratch
+// when the manifest is missing or unreadable, or if rebuild is set.
+//
+// A file that was complete as of the manifest record has its final size
+// recorded, any other file is scanned for its intact records. Anything past
+// those is the remainder of an interrupted write; it is left in place, as a
+// value file is never appended to across opens.
+func (vs *vStorage) recover(rebuild bool) error {
+	var hasManifest bool
+	if !rebuild {
+		var err error
+		if hasManifest, err = vs.loadManifest(); err != nil {
+			return err
+		}
+	}
+	known := vs.Files
+	if !hasManifest {
+		known = nil
+	}
+	vs.Files = make(map[fileKey]*fileStat)
+
+	files, err := vs.listFiles()
+	if err != nil {
+		return err
+	}
+
+	for level := 0; level < LEVEL; level++ {
+		nums := files[level]
+		if len(nums) == 0 {
+			continue
+		}
+		l := &vs.Level[level]
+		offset := l.Offset
+		if level == 0 {
+			offset = vs.Offset
+		}
+		end := l.End // The last file as of the manifest.
+		if !hasManifest {
+			l.Start, l.End = nums[0], nums[len(nums)-1]
+		} else if last := nums[len(nums)-1]; last > l.End {
+			// Files created after the last manifest record.
+			l.End = last
+		}
+		for _, num := range nums {
+			key := fileKey{level, num}
+			stat := known[key]
+			if num < l.Start || (known != nil && stat == nil && num <= end) {
+				// Compacted away, but not removed before shutdown. Read-only,
+				// it is left for the next writable open.
+				if vs.ReadOnly {
+					continue
+				}
+				if err := vs.Stor.Remove(valueFileDesc(level, num)); err != nil {
+					return err
+				}
+				continue
+			}
+			if hasManifest && num < end {
+				if stat == nil {
+					// The manifest predates the file stats.
+					size, err := vs.fileSize(level, num)
+					if err != nil {
+						return err
+					}
+					stat = &fileStat{Size: size}
+					vs.Recount = true
+				}
+				vs.Files[key] = stat
+				continue
+			}
+			if stat == nil {
+				stat = &fileStat{}
+			}
+			from := 0
+			if hasManifest && num == end {
+				from = offset
+			}
+			size, nextSeq, err := vs.scanFile(level, num, from)
+			if err != nil {
+				return err
+			}
+			if nextSeq > vs.Sequence {
+				vs.Sequence = nextSeq
+			}
+			stat.Size = int64(size)
+			vs.Files[key] = stat
+		}
+
+		offset = 0
+		if stat := vs.Files[fileKey{level, l.End}]; stat != nil {
+			offset = int(stat.Size)
+		}
+		if level == 0 {
+			vs.Offset = offset
+		} else {
+			l.Offset = offset
+		}
+		vs.updateStart(level)
+	}
+	vs.CurrentFileNumber = vs.Level[0].End
+	if !hasManifest && len(vs.Files) > 0 {
+		vs.Recount = true
+	}
+	vs.Size, vs.Dead = 0, 0
+	for _, stat := range vs.Files {
+		if stat.Dead > stat.Size {
+			stat.Dead = stat.Size
+		}
+		vs.Size += stat.Size
+		vs.Dead += stat.Dead
+	}
+	return nil
+}
+
+// updateStart sets the start of the given level to its lowest file number.
+// The caller must hold the mutex, unless the value log is not shared yet.
+func (vs *vStorage) updateStart(level int) {
+	l := &vs.Level[level]
+	start := l.End
+	for key := range vs.Files {
+		if key.Level == level && key.Number < start {
+			start = key.Number
+		}
+	}
+	l.Start = start
+}
+
+// listFiles returns the sorted file numbers of the value files, by level.
+func (vs *vStorage) listFiles() ([][]int, error) {
+	fds, err := vs.Stor.List(storage.TypeValue)
+	if err != nil {
+		return nil, err
+	}
+	files := make([][]int, LEVEL)
+	for _, fd := range fds {
+		if level, num := parseValueFileDesc(fd); level < LEVEL {
+			files[level] = append(files[level], num)
+		}
+	}
+	for _, nums := range files {
+		sort.Ints(nums)
+	}
+	return files, nil
+}
+
+// fileSize returns the size of the given file.
+func (vs *vStorage) fileSize(level, fileNumber int) (int64, error) {
+	r, err := vs.Stor.Open(valueFileDesc(level, fileNumber))
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return r.Seek(0, io.SeekEnd)
+}
+
+// scanFile reads the records of the given file from offset on and returns
+// the end of the last intact record along with the sequence number following
+// the highest one seen, or zero if there is no record.
+func (vs *vStorage) scanFile(level, fileNumber, offset int) (end int, nextSeq uint64, err error) {
+	r, err := vs.Stor.Open(valueFileDesc(level, fileNumber))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, 0, nil
+		}
+		return 0, 0, err
+	}
+	defer r.Close()
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, 0, err
+	}
+	if int64(offset) > size {
+		// The file lost records counted on already, like those written
+		// but not synced before a machine crash; it is scanned anew.
+		offset = 0
+	}
+	if _, err := r.Seek(int64(offset), io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	end = offset
+	rr := newRecordReader(r, offset, size)
+	for {
+		record, err := rr.next()
+		if err == io.EOF || err == errBadRecord {
+			break
+		} else if err != nil {
+			return 0, 0, err
+		}
+		if seq := recordSeq(record); seq >= nextSeq {
+			nextSeq = seq + 1
+		}
+		end += len(record)
+	}
+	return end, nextSeq, nil
+}
+
+// Put appends the given key/value pair to the value log and returns the
+// location of the record.
+func (vs *vStorage) Put(key []byte, value []byte) (location []byte, err error) {
+	buffer := vs.appendRecord(nil, key, value)
+	locations, err := vs.write(buffer, []int{len(buffer)})
+	if err != nil {
+		return nil, err
+	}
+	return locations[0], nil
+}
+
+// appendRecord encodes the given key/value pair as a value record and
+// appends it to dst. The sequence number and the checksum are left to
+// write.
+func (vs *vStorage) appendRecord(dst []byte, key, value []byte) []byte {
+	typ := byte(vRecordNoCompression)
+	if vs.Compression == opt.SnappyCompression {
+		// Like leveldb, keep the value uncompressed unless that saves at
+		// least 12.5%.
+		if compressed := snappy.Encode(nil, value); len(compressed) < len(value)-len(value)/8 {
+			typ, value = vRecordSnappyCompression, compressed
+		}
+	}
+	l := vRecordHeaderLen64 + len(key) + len(value)
+	n := len(dst)
+	if cap(dst)-n < l {
+		ndst := make([]byte, n, 2*cap(dst)+l)
+		copy(ndst, dst)
+		dst = ndst
+	}
+	dst = dst[:n+l]
+	buffer := dst[n:]
+	binary.BigEndian.PutUint32(buffer[4:], uint32(l))
+	binary.BigEndian.PutUint32(buffer[8:], uint32(len(key)))
+	buffer[8] = typ | vRecordSeq64
+	binary.BigEndian.PutUint32(buffer[12:], uint32(len(value)))
+	copy(buffer[vRecordHeaderLen64:], key)
+	copy(buffer[vRecordHeaderLen64+len(key):], value)
+	return dst
+}
 
+// write appends the given encoded records to level 0 of the value log with
+// a single write and returns their locations. The records lie back to back
+// in buffer, lens holds their lengths.
+func (vs *vStorage) write(buffer []byte, lens []int) (locations [][]byte, err error) {
+	if vs.ReadOnly {
+		return nil, ErrReadOnly
+	}
 	vs.Mutex.Lock()
-	binary.BigEndian.PutUint32(buffer[12: ], uint32(vs.Sequence))
-	vs.CurrentFile.WriteAt(buffer, int64(vs.Offset))
-	location = generateLocation(l, vs.CurrentFileNumber, vs.Offset, int(vs.Sequence), 0)
-	vs.Offset += l
-	vs.Sequence += 1
-	if vs.Offset >= Capacity {
-		vs.Offset = 0
-		vs.CurrentFileNumber += 1
-		vs.CurrentFile.Close()
-		filename := vs.generateFilename(0, vs.CurrentFileNumber)
-		vs.CurrentFile, _ = os.OpenFile(filename, os.O_CREATE | os.O_RDWR, os.ModePerm)
-		vs.Level[0].End = vs.CurrentFileNumber
+	if vs.CurrentFile == nil || vs.Torn || vs.Offset >= vs.FileSize {
+		// An earlier write or rotation failed.
+		if err := vs.rotate(); err != nil {
+			vs.Mutex.Unlock()
+			return nil, err
+		}
+	}
+	locations = make([][]byte, len(lens))
+	o := 0
+	for i, l := range lens {
+		record := buffer[o : o+l]
+		binary.BigEndian.PutUint64(record[16:], vs.Sequence+uint64(i))
+		setRecordChecksum(record)
+		locations[i] = recordLocation(record, 0, vs.CurrentFileNumber, vs.Offset+o)
+		o += l
+	}
+	// A failed write leaves the offset as is, the partially written
+	// records past it are never read.
+	if _, err := vs.CurrentFile.Write(buffer); err != nil {
+		vs.Torn = true
+		vs.Mutex.Unlock()
+		return nil, err
+	}
+	atomic.AddUint64(&vs.ioWrite, uint64(len(buffer)))
+	vs.Offset += len(buffer)
+	vs.Sequence += uint64(len(lens))
+	vs.Files[fileKey{0, vs.CurrentFileNumber}].Size += int64(len(buffer))
+	size := atomic.AddInt64(&vs.Size, int64(len(buffer)))
+	if vs.Offset >= vs.FileSize {
+		// The records are written already; should the rotation fail it is
+		// retried by the next write.
+		if err := vs.rotate(); err != nil {
+			vs.logf("valuelog@rotate error %q", err)
+		}
 	}
 	vs.Mutex.Unlock()
 
-	size := atomic.AddInt64(&vs.Size, int64(l))
-	if !vs.Compacting {
-		if size > WarningLine {
-			vs.Compacting = true
-			go vs.compact()
+	if size > vs.WarningLine {
+		vs.maybeCompact()
+	}
+
+	return locations, nil
+}
+
+// rotate switches level 0 over to a new value file. The full file is
+// synced first, so the manifest never lists a file as complete before its
+// records are on disk. The caller must hold the mutex.
+func (vs *vStorage) rotate() error {
+	if vs.CurrentFile != nil {
+		if err := vs.CurrentFile.Sync(); err != nil {
+			return err
+		}
+		vs.CurrentFile.Close()
+		vs.CurrentFile = nil
+	}
+	f, err := vs.createFile(0)
+	if err != nil {
+		return err
+	}
+	vs.CurrentFile = f
+	vs.Torn = false
+	return vs.logState()
+}
+
+// createFile creates a new last file for the given level; the last file is
+// created anew instead if it holds no records, a torn tail aside. The caller
+// must hold the mutex, unless the value log is not shared yet.
+func (vs *vStorage) createFile(level int) (storage.Writer, error) {
+	l := &vs.Level[level]
+	num := l.End + 1
+	if stat := vs.Files[fileKey{level, l.End}]; stat != nil && stat.Size == 0 {
+		num = l.End
+	}
+	w, err := vs.Stor.Create(valueFileDesc(level, num))
+	if err != nil {
+		return nil, err
+	}
+	l.End, l.Offset = num, 0
+	if level == 0 {
+		vs.CurrentFileNumber, vs.Offset = num, 0
+	}
+	if key := (fileKey{level, num}); vs.Files[key] == nil {
+		vs.Files[key] = &fileStat{}
+	}
+	return w, nil
+}
+
+// Sync commits the records written so far to stable storage. It must be
+// called before anything that refers to those records, like a synced
+// journal write or a flushed table, is made durable.
+func (vs *vStorage) Sync() error {
+	vs.Mutex.Lock()
+	defer vs.Mutex.Unlock()
+	if vs.CurrentFile != nil {
+		if err := vs.CurrentFile.Sync(); err != nil {
+			return err
+		}
+	}
+	for _, w := range vs.CompactFiles {
+		if err := w.Sync(); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	return location
+// Separate returns the LSM value for the given key/value pair: the value
+// itself if it is smaller than the threshold, or else the location of the
+// value after appending it to the value log.
+func (vs *vStorage) Separate(key, value []byte) ([]byte, error) {
+	if !vs.separable(key, value) {
+		return inlineValue(value), nil
+	}
+	return vs.Put(key, value)
 }
 
-func (vs *vStorage)Get(location []byte) (value []byte) {
-	length, fileNumber, offset, _ , level:= parseLocation(location)
-	//fmt.Println(length, fileNumber, offset, seq, level)
-	buffer := make([]byte, length)
-	fileName := vs.generateFilename(level, fileNumber)
-	file, _ := os.OpenFile(fileName, os.O_RDONLY, os.ModePerm)
-	file.ReadAt(buffer, int64(offset))
+// separateBatches converts the values of all 'put operation' records of the
+// given batches into their LSM form, see Separate, and appends the records
+// into dst. The separated values of all batches are appended to the value
+// log with a single write.
+//
+// Only dst is ever applied to the memdb, so the value log writes happen
+// strictly before the batches are committed; a write that fails in between
+// leaves unreferenced value records behind, which are accounted dead, see
+// discard.
+func (vs *vStorage) separateBatches(batches []*Batch, dst *Batch) error {
+	var (
+		buffer []byte
+		lens   []int
+	)
+	for _, b := range batches {
+		for _, index := range b.index {
+			if key, value := index.kv(b.data); index.keyType == keyTypeVal && vs.separable(key, value) {
+				n := len(buffer)
+				buffer = vs.appendRecord(buffer, key, value)
+				lens = append(lens, len(buffer)-n)
+			}
+		}
+	}
+	var locations [][]byte
+	if len(lens) > 0 {
+		var err error
+		if locations, err = vs.write(buffer, lens); err != nil {
+			return err
+		}
+	}
+	for _, b := range batches {
+		for _, index := range b.index {
+			key, value := index.kv(b.data)
+			if index.keyType == keyTypeVal {
+				if vs.separable(key, value) {
+					value, locations = locations[0], locations[1:]
+				} else {
+					value = inlineValue(value)
+				}
+			}
+			dst.appendRec(index.keyType, key, value)
+		}
+	}
+	return nil
+}
 
-	keySize := binary.BigEndian.Uint32(buffer[4:])
-	valueSize := binary.BigEndian.Uint32(buffer[8:])
-	//fmt.Println(keySize)
-	//fmt.Println(valueSize)
-	return buffer[16 + keySize: 16 + keySize + valueSize]
+// discard accounts the separated values of the given batch, as produced by
+// separateBatches, as dead; the batch failed to be committed.
+func (vs *vStorage) discard(b *Batch) {
+	var locations [][]byte
+	for _, index := range b.index {
+		if _, value := index.kv(b.data); index.keyType == keyTypeVal && isValuePointer(value) {
+			locations = append(locations, value)
+		}
+	}
+	if err := vs.markDead(locations); err != nil {
+		vs.logf("valuelog@discard error %q", err)
+	}
 }
 
-func generateLocation(length int, fileNumber int, offset int, seq int, level int) []byte{
-	buffer := make([]byte, 20)
-	binary.BigEndian.PutUint32(buffer[0:], uint32(length))
-	binary.BigEndian.PutUint32(buffer[4:], uint32(fileNumber))
-	binary.BigEndian.PutUint32(buffer[8:], uint32(offset))
-	binary.BigEndian.PutUint32(buffer[12:], uint32(seq))
-	binary.BigEndian.PutUint32(buffer[16:], uint32(level))
-	return buffer
+// separable reports whether the value of the given key/value pair goes to
+// the value log, as decided by the separation policy.
+func (vs *vStorage) separable(key, value []byte) bool {
+	return vs.Separation != nil && len(key) <= vRecordMaxKeyLen && vs.Separation.Separate(key, value)
 }
 
-func parseLocation(location []byte) (length int, fileNumber int, offset int, seq int, level int) {
-	length = int(binary.BigEndian.Uint32(location[0:]))
-	fileNumber = int(binary.BigEndian.Uint32(location[4:]))
-	offset = int(binary.BigEndian.Uint32(location[8:]))
-	seq = int(binary.BigEndian.Uint32(location[12:]))
-	level = int(binary.BigEndian.Uint32(location[16:]))
-	return
+// isValuePointer reports whether the given LSM value is a location.
+func isValuePointer(v []byte) bool {
+	return len(v) > 0 && (v[0] == valueTagPointer || v[0] == valueTagVarPointer)
 }
 
-func (vs *vStorage)generateFilename(level int, fileNumber int) string{
-	filename := path.Join(vs.Path, "level_" + strconv.Itoa(level) + "_number_" + strconv.Itoa(fileNumber) + ".value")
-	return filename
+// inlineValue returns the LSM form of a value stored inline.
+func inlineValue(value []byte) []byte {
+	v := make([]byte, 1+len(value))
+	v[0] = valueTagInline
+	copy(v[1:], value)
+	return v
 }
 
-func (vs *vStorage)Close() () {
-	vs.CurrentFile.Close()
-	manifestPath := path.Join(vs.Path, Manifest)
-	manifestFile, _ := os.OpenFile(manifestPath, os.O_CREATE | os.O_RDWR, os.ModePerm)
-	bufferSize := ManifestSize
-	buffer := make([]byte, bufferSize)
-	binary.BigEndian.PutUint32(buffer[0:], uint32(vs.Sequence))
-	binary.BigEndian.PutUint64(buffer[4:], uint64(vs.Size))
-	binary.BigEndian.PutUint32(buffer[12:], uint32(vs.CurrentFileNumber))
-	binary.BigEndian.PutUint32(buffer[16:], uint32(vs.Offset))
-	for i := 0; i < LEVEL; i++ {
-		binary.BigEndian.PutUint32(buffer[20 + i * 12:], uint32(vs.Level[i].Start))
-		binary.BigEndian.PutUint32(buffer[20 + i * 12 + 4:], uint32(vs.Level[i].End))
-		binary.BigEndian.PutUint32(buffer[20 + i * 12 + 8:], uint32(vs.Level[i].Offset))
+// Resolve returns the value for the given LSM value, reading it from the
+// value log if the LSM value is a location.
+func (vs *vStorage) Resolve(v []byte) ([]byte, error) {
+	if len(v) == 0 {
+		return nil, newErrValueCorrupted(-1, -1, -1, "missing value tag")
+	}
+	switch v[0] {
+	case valueTagInline:
+		return v[1:], nil
+	case valueTagPointer, valueTagVarPointer:
+		return vs.Get(v)
+	}
+	return nil, newErrValueCorrupted(-1, -1, -1, fmt.Sprintf("invalid value tag %#x", v[0]))
+}
+
+// Get reads the value at the given location. It returns an error of type
+// ErrCorrupted if the location or the record it points to is invalid.
+func (vs *vStorage) Get(location []byte) (value []byte, err error) {
+	if _, fileNumber, offset, _, level, ok := parseLocation(location); ok && vs.vcache != nil {
+		ns, key := valueCacheNS(level, fileNumber), uint64(offset)
+		if ch := vs.vcache.Get(ns, key, nil); ch != nil {
+			atomic.AddUint64(&vs.vcacheHit, 1)
+			value = append([]byte{}, ch.Value().([]byte)...)
+			ch.Release()
+			return value, nil
+		}
+		atomic.AddUint64(&vs.vcacheMiss, 1)
+		if value, err = vs.readValue(location); err != nil {
+			return nil, err
+		}
+		cached := append([]byte{}, value...)
+		if ch := vs.vcache.Get(ns, key, func() (int, cache.Value) {
+			return len(cached), cached
+		}); ch != nil {
+			ch.Release()
+		}
+		return value, nil
+	}
+	return vs.readValue(location)
+}
+
+// readValue reads the value at the given location from its value file.
+func (vs *vStorage) readValue(location []byte) ([]byte, error) {
+	record, err := vs.readRecord(location)
+	if err != nil {
+		return nil, err
+	}
+	defer vs.bpool.Put(record)
+	hl, keySize := recordHeaderLen(record), recordKeyLen(record)
+	valueSize := int(binary.BigEndian.Uint32(record[12:]))
+	value := record[hl+keySize : hl+keySize+valueSize]
+	if recordCompression(record) == vRecordSnappyCompression {
+		if value, err = snappy.Decode(nil, value); err != nil {
+			_, fileNumber, offset, _, level, _ := parseLocation(location)
+			return nil, newErrValueCorrupted(level, fileNumber, offset, "corrupted compressed value")
+		}
+		return value, nil
+	}
+	return append([]byte{}, value...), nil
+}
+
+// valueCacheNS returns the value cache namespace of the given value file;
+// the values of a file are keyed by their record offset.
+func valueCacheNS(level, fileNumber int) uint64 {
+	return uint64(level)<<32 | uint64(fileNumber)
+}
+
+// vFile is a cached value file opened for reading.
+type vFile struct {
+	storage.Reader
+	mu   sync.Mutex // Serializes seeking to the end.
+	size int64      // Size as last seen, accessed atomically.
+}
+
+func (f *vFile) Release() {
+	f.Close()
+}
+
+// contains reports whether n bytes at offset lie within the file. The size
+// is looked up anew if they lie past the size last seen, as the current
+// file grows.
+func (f *vFile) contains(offset, n int) (bool, error) {
+	end := int64(offset) + int64(n)
+	if end <= atomic.LoadInt64(&f.size) {
+		return true, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+	atomic.StoreInt64(&f.size, size)
+	return end <= size, nil
+}
+
+// openFile opens the given value file for reading. It returns a cache
+// handle, which should be released after use.
+func (vs *vStorage) openFile(level, fileNumber int) (ch *cache.Handle, err error) {
+	ns := cache.NamespaceGetter{Cache: vs.fcache, NS: uint64(level)}
+	ch = ns.Get(uint64(fileNumber), func() (size int, value cache.Value) {
+		var f storage.Reader
+		f, err = vs.Stor.Open(valueFileDesc(level, fileNumber))
+		if err != nil {
+			return 0, nil
+		}
+		return 1, &vFile{Reader: f}
+	})
+	if ch == nil && err == nil {
+		err = ErrClosed
 	}
-	manifestFile.Write(buffer)
-	manifestFile.Close()
 	return
 }
 
-func (vs *vStorage)compact() {
+// readRecord reads and checksums the record at the given location. The
+// record is read into a buffer from the pool, which should be returned to
+// the pool after use.
+func (vs *vStorage) readRecord(location []byte) ([]byte, error) {
+	length, fileNumber, offset, _, level, ok := parseLocation(location)
+	if !ok {
+		return nil, newErrValueCorrupted(-1, -1, -1, "invalid location")
+	}
+	if length < vRecordHeaderLen {
+		return nil, newErrValueCorrupted(level, fileNumber, offset, fmt.Sprintf("invalid record length %d", length))
+	}
+	ch, err := vs.openFile(level, fileNumber)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, newErrValueCorrupted(level, fileNumber, offset, "missing value file")
+		}
+		return nil, err
+	}
+	defer ch.Release()
+	// Check the location against the file before allocating the record,
+	// a corrupted length may be huge.
+	f := ch.Value().(*vFile)
+	if ok, err := f.contains(offset, length); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, newErrValueCorrupted(level, fileNumber, offset, "truncated record")
+	}
+	record := vs.bpool.Get(length)
+	atomic.AddUint64(&vs.ioRead, uint64(length))
+	if _, err := f.ReadAt(record, int64(offset)); err != nil {
+		vs.bpool.Put(record)
+		if err == io.EOF {
+			return nil, newErrValueCorrupted(level, fileNumber, offset, "truncated record")
+		}
+		return nil, err
+	}
+	if int(binary.BigEndian.Uint32(record[4:])) != length {
+		vs.bpool.Put(record)
+		return nil, newErrValueCorrupted(level, fileNumber, offset, "record length mismatch")
+	}
+	if !validRecord(record) {
+		vs.bpool.Put(record)
+		return nil, newErrValueCorrupted(level, fileNumber, offset, "checksum mismatch")
+	}
+	return record, nil
+}
+
+// verifyRecord reads the record at the given location and checks that it
+// belongs to the given key.
+func (vs *vStorage) verifyRecord(key, location []byte) error {
+	record, err := vs.readRecord(location)
+	if err != nil {
+		return err
+	}
+	defer vs.bpool.Put(record)
+	_, fileNumber, offset, seq, level, _ := parseLocation(location)
+	if recordSeq(record) != seq {
+		return newErrValueCorrupted(level, fileNumber, offset, "record sequence mismatch")
+	}
+	if !bytes.Equal(recordKey(record), key) {
+		return newErrValueCorrupted(level, fileNumber, offset, "record key mismatch")
+	}
+	return nil
+}
 
-	lengthBytes := make([]byte, 4)
-	for {
-		for i := 0; i < LEVEL - 1; i++ {
-			//fmt.Printf("compacting level %d size %d\n", i, vs.Size)
-			wFilename := vs.generateFilename(i + 1, vs.Level[i + 1].End)
-			wFile, err := os.OpenFile(wFilename, os.O_CREATE | os.O_RDWR, os.ModePerm)
-			if err != nil {
-				fmt.Println(err)
-			}
-			for vs.Level[i].Start < vs.Level[i].End {
-				rFilename := vs.generateFilename(i, vs.Level[i].Start)
-				rFile, err := os.OpenFile(rFilename, os.O_RDWR, os.ModePerm)
-				if err != nil {
-					fmt.Println(err)
-				}
-				reader := bufio.NewReader(rFile)
-				for {
-					//n, e := reader.Read(lengthBytes)
-					n, e := io.ReadFull(reader, lengthBytes)
-					if n <= 0 || e != nil {
-						break
-					}
-					length := binary.BigEndian.Uint32(lengthBytes)
-					//fmt.Println(length)
-					buffer := make([]byte, length)
-
-					//reader.Read(buffer[4:])
-					io.ReadFull(reader, buffer[4:])
-					keySize := binary.BigEndian.Uint32(buffer[4:])
-					//valueSize := binary.BigEndian.Uint32(buffer[8:])
-					seq := binary.BigEndian.Uint32(buffer[12:])
-					key := buffer[16: 16 + keySize]
-					//fmt.Println(string(key))
-					//value := buffer[16 + keySize: 16 + keySize + valueSize]
-					//fmt.Println(string(key))
-					//fmt.Println(keySize)
-					se := vs.KeyStore.acquireSnapshot()
-					location, err := vs.KeyStore.get(nil, nil, key, se.seq, nil)
-					vs.KeyStore.releaseSnapshot(se)
-					if err != nil {
-						vs.Mutex.Lock()
-						vs.Size -= int64(length)
-						vs.Mutex.Unlock()
-						//atomic.AddInt64(&vs.Size, int64(-length))
-					} else {
-						_, _, _, seqOld, _ := parseLocation(location)
-						if seqOld != int(seq) {
-							vs.Mutex.Lock()
-							vs.Size -= int64(length)
-							vs.Mutex.Unlock()
-							//atomic.AddInt64(&vs.Size, int64(-length))
-						} else {
-							binary.BigEndian.PutUint32(buffer[0:], uint32(length))
-							binary.BigEndian.PutUint32(buffer[12:], uint32(seq))
-							wFile.WriteAt(buffer, int64(vs.Level[i + 1].Offset))
-							vs.Mutex.Lock()
-							seq := vs.Sequence
-							vs.Sequence += 1
-							vs.Mutex.Unlock()
-							location := generateLocation(int(length), vs.Level[i + 1].End, vs.Level[i + 1].Offset, seq, i + 1)
-							//fmt.Println(length, vs.Level[i + 1].End, vs.Level[i + 1].Offset, seq, i + 1)
-							//vs.KeyStore.Put(key, location, nil)
-							vs.KeyStore.putRec(keyTypeVal, key, location, nil)
-							vs.Level[i + 1].Offset += int(length)
-							if vs.Level[i + 1].Offset >= Capacity {
-								vs.Level[i + 1].Offset = 0
-								vs.Level[i + 1].End += 1
-								wFile.Close()
-								wFilename = vs.generateFilename(i + 1, vs.Level[i + 1].End)
-								wFile, err = os.OpenFile(wFilename, os.O_CREATE | os.O_RDWR, os.ModePerm)
-								if err != nil {
-									fmt.Println(err)
-								}
-							}
-						}
-					}
-				}
+// checkLocation reports whether the record at the given location lies
+// within an existing value file, without reading it.
+func (vs *vStorage) checkLocation(location []byte) error {
+	length, fileNumber, offset, _, level, ok := parseLocation(location)
+	if !ok {
+		return newErrValueCorrupted(-1, -1, -1, "invalid location")
+	}
+	vs.Mutex.Lock()
+	stat := vs.Files[fileKey{level, fileNumber}]
+	var size int64
+	if stat != nil {
+		size = stat.Size
+	}
+	vs.Mutex.Unlock()
+	if stat == nil {
+		return newErrValueCorrupted(level, fileNumber, offset, "missing value file")
+	}
+	if length < vRecordHeaderLen || int64(offset)+int64(length) > size {
+		return newErrValueCorrupted(level, fileNumber, offset, "truncated record")
+	}
+	return nil
+}
 
-				rFile.Close()
-				err = os.Remove(rFilename)
-				if err != nil {
-					fmt.Println(err)
-				}
-				vs.Level[i].Start += 1
-				if vs.Size < SafeLine {
-					vs.Compacting = false
-					return
-				}
-			}
-			wFile.Close()
+// recordHeaderLen returns the header length of the given encoded record.
+func recordHeaderLen(record []byte) int {
+	if record[8]&vRecordSeq64 != 0 {
+		return vRecordHeaderLen64
+	}
+	return vRecordHeaderLen
+}
+
+// recordCompression returns the compression type of the given encoded
+// record.
+func recordCompression(record []byte) byte {
+	return record[8] &^ vRecordSeq64
+}
+
+// recordKeyLen returns the key length of the given encoded record.
+func recordKeyLen(record []byte) int {
+	return int(binary.BigEndian.Uint32(record[8:]) & vRecordMaxKeyLen)
+}
+
+// recordKey returns the key of the given encoded record.
+func recordKey(record []byte) []byte {
+	hl := recordHeaderLen(record)
+	return record[hl : hl+recordKeyLen(record)]
+}
+
+// recordSeq returns the sequence number of the given encoded record.
+func recordSeq(record []byte) uint64 {
+	if record[8]&vRecordSeq64 != 0 {
+		return binary.BigEndian.Uint64(record[16:])
+	}
+	return uint64(binary.BigEndian.Uint32(record[16:]))
+}
+
+// setRecordSeq sets the sequence number of the given encoded record and
+// returns the record. A record without vRecordSeq64 is copied into one with
+// it first. The checksum is left to the caller.
+func setRecordSeq(record []byte, seq uint64) []byte {
+	if record[8]&vRecordSeq64 == 0 {
+		nrecord := make([]byte, len(record)+vRecordHeaderLen64-vRecordHeaderLen)
+		copy(nrecord, record[:16])
+		copy(nrecord[vRecordHeaderLen64:], record[vRecordHeaderLen:])
+		binary.BigEndian.PutUint32(nrecord[4:], uint32(len(nrecord)))
+		nrecord[8] |= vRecordSeq64
+		record = nrecord
+	}
+	binary.BigEndian.PutUint64(record[16:], seq)
+	return record
+}
+
+// setRecordChecksum fills in the checksum of the given encoded record.
+func setRecordChecksum(record []byte) {
+	binary.BigEndian.PutUint32(record, util.NewCRC(record[4:]).Value())
+}
+
+// validRecord reports whether the given encoded record is intact.
+func validRecord(record []byte) bool {
+	if len(record) < vRecordHeaderLen || int(binary.BigEndian.Uint32(record[4:])) != len(record) {
+		return false
+	}
+	if c := recordCompression(record); c != vRecordNoCompression && c != vRecordSnappyCompression {
+		return false
+	}
+	keySize := recordKeyLen(record)
+	valueSize := int(binary.BigEndian.Uint32(record[12:]))
+	if recordHeaderLen(record)+keySize+valueSize != len(record) {
+		return false
+	}
+	return binary.BigEndian.Uint32(record) == util.NewCRC(record[4:]).Value()
+}
+
+var errBadRecord = fmt.Errorf("leveldb: bad value record")
+
+// recordReader reads value records sequentially.
+type recordReader struct {
+	r      *bufio.Reader
+	offset int   // Offset of the next record.
+	size   int64 // Size of the input, records never extend past it.
+	header [vRecordHeaderLen]byte
+}
+
+func newRecordReader(r io.Reader, offset int, size int64) *recordReader {
+	return &recordReader{r: bufio.NewReader(r), offset: offset, size: size}
+}
+
+// next returns the next record. It returns io.EOF at the end of the input
+// and errBadRecord on a torn or corrupted record, any other error is an
+// I/O error.
+func (rr *recordReader) next() ([]byte, error) {
+	if _, err := io.ReadFull(rr.r, rr.header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errBadRecord
+		}
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint32(rr.header[4:]))
+	if length < vRecordHeaderLen || int64(rr.offset)+int64(length) > rr.size {
+		return nil, errBadRecord
+	}
+	record := make([]byte, length)
+	copy(record, rr.header[:])
+	if _, err := io.ReadFull(rr.r, record[vRecordHeaderLen:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errBadRecord
 		}
+		return nil, err
+	}
+	if !validRecord(record) {
+		return nil, errBadRecord
+	}
+	rr.offset += length
+	return record, nil
+}
+
+// recordLocation returns the location of the given encoded record, which
+// lies at offset in the given file.
+func recordLocation(record []byte, level, fileNumber, offset int) []byte {
+	if record[8]&vRecordSeq64 != 0 {
+		return generateLocation(len(record), fileNumber, offset, recordSeq(record), level)
 	}
+	buffer := make([]byte, locationLen)
+	buffer[0] = valueTagPointer
+	binary.BigEndian.PutUint32(buffer[1:], uint32(len(record)))
+	binary.BigEndian.PutUint32(buffer[5:], uint32(fileNumber))
+	binary.BigEndian.PutUint32(buffer[9:], uint32(offset))
+	binary.BigEndian.PutUint32(buffer[13:], uint32(recordSeq(record)))
+	binary.BigEndian.PutUint32(buffer[17:], uint32(level))
+	return buffer
+}
 
+// generateLocation encodes a location tagged valueTagVarPointer.
+func generateLocation(length int, fileNumber int, offset int, seq uint64, level int) []byte {
+	buffer := make([]byte, 1+5*binary.MaxVarintLen64)
+	buffer[0] = valueTagVarPointer
+	n := 1
+	n += binary.PutUvarint(buffer[n:], uint64(length))
+	n += binary.PutUvarint(buffer[n:], uint64(level))
+	n += binary.PutUvarint(buffer[n:], uint64(fileNumber))
+	n += binary.PutUvarint(buffer[n:], uint64(offset))
+	n += binary.PutUvarint(buffer[n:], seq)
+	return append([]byte{}, buffer[:n]...)
 }
 
-func (vs *vStorage)SetKeyStore(keyStore *DB) {
-	vs.KeyStore = keyStore
-}
\ No newline at end of file
+// parseLocation decodes a location of either layout. It returns false if
+// the location is malformed.
+func parseLocation(location []byte) (length int, fileNumber int, offset int, seq uint64, level int, ok bool) {
+	if len(location) == 0 {
+		return
+	}
+	switch location[0] {
+	case valueTagPointer:
+		if len(location) != locationLen {
+			return
+		}
+		length = int(binary.BigEndian.Uint32(location[1:]))
+		fileNumber = int(binary.BigEndian.Uint32(location[5:]))
+		offset = int(binary.BigEndian.Uint32(location[9:]))
+		seq = uint64(binary.BigEndian.Uint32(location[13:]))
+		level = int(binary.BigEndian.Uint32(location[17:]))
+		return length, fileNumber, offset, seq, level, true
+	case valueTagVarPointer:
+		var fields [5]uint64
+		b := location[1:]
+		for i := range fields {
+			x, n := binary.Uvarint(b)
+			if n <= 0 {
+				return
+			}
+			fields[i], b = x, b[n:]
+		}
+		if len(b) != 0 || fields[0] > math.MaxInt32 || fields[1] >= LEVEL || fields[2] > math.MaxUint32 || fields[3] > math.MaxInt64 {
+			return
+		}
+		return int(fields[0]), int(fields[2]), int(fields[3]), fields[4], int(fields[1]), true
+	}
+	return
+}
+
+// valueFileDesc returns the file descriptor of the given value file.
+func valueFileDesc(level, fileNumber int) storage.FileDesc {
+	return storage.FileDesc{Type: storage.TypeValue, Num: int64(level)<<32 | int64(fileNumber)}
+}
+
+// parseValueFileDesc is the inverse of valueFileDesc.
+func parseValueFileDesc(fd storage.FileDesc) (level, fileNumber int) {
+	return int(fd.Num >> 32), int(fd.Num & 0xffffffff)
+}
+
+// A manifest starts with a format record, vManifestMagic followed by the
+// format version as a big-endian uint32; the state records following it
+// are laid out according to that version. Manifests written before the
+// format was versioned lack the format record and are of version 0.
+const (
+	vManifestMagic   = "VLOGFMT:"
+	vManifestVersion = 1
+)
+
+// A version 1 state record is a sequence of uvarints:
+//
+//	sequence, size, currentFileNumber, offset
+//	LEVEL times:
+//	  start, end, offset
+//	count
+//	count times:
+//	  level, number, size, dead
+//
+// A version 0 state record is the fixed ManifestSize long state, followed
+// by the file stats:
+//
+//	count   uint32
+//	count times:
+//	  level   uint32
+//	  number  uint32
+//	  size    uint64
+//	  dead    uint64
+//
+// All of its integers are uint32 unless noted otherwise, and big-endian.
+// Records written before the file stats were added lack them entirely.
+const fileStatLen = 24
+
+// formatRecord returns the format record of a manifest of the current
+// version.
+func formatRecord() []byte {
+	buffer := make([]byte, len(vManifestMagic)+4)
+	copy(buffer, vManifestMagic)
+	binary.BigEndian.PutUint32(buffer[len(vManifestMagic):], vManifestVersion)
+	return buffer
+}
+
+// parseFormatRecord returns the version held by the given format record. It
+// returns false if the record is not a format record.
+func parseFormatRecord(buffer []byte) (version int, ok bool) {
+	if len(buffer) != len(vManifestMagic)+4 || string(buffer[:len(vManifestMagic)]) != vManifestMagic {
+		return 0, false
+	}
+	return int(binary.BigEndian.Uint32(buffer[len(vManifestMagic):])), true
+}
+
+// encodeState encodes the value log state as a manifest record of the
+// current version.
+func (vs *vStorage) encodeState() []byte {
+	var (
+		buffer  = make([]byte, 0, (4+LEVEL*3+1+len(vs.Files)*4)*binary.MaxVarintLen64)
+		scratch [binary.MaxVarintLen64]byte
+	)
+	put := func(x uint64) {
+		n := binary.PutUvarint(scratch[:], x)
+		buffer = append(buffer, scratch[:n]...)
+	}
+	put(vs.Sequence)
+	put(uint64(atomic.LoadInt64(&vs.Size)))
+	put(uint64(vs.CurrentFileNumber))
+	put(uint64(vs.Offset))
+	for i := 0; i < LEVEL; i++ {
+		put(uint64(vs.Level[i].Start))
+		put(uint64(vs.Level[i].End))
+		put(uint64(vs.Level[i].Offset))
+	}
+	put(uint64(len(vs.Files)))
+	for key, stat := range vs.Files {
+		put(uint64(key.Level))
+		put(uint64(key.Number))
+		put(uint64(stat.Size))
+		put(uint64(stat.Dead))
+	}
+	return buffer
+}
+
+var errBadState = fmt.Errorf("leveldb: bad value log state record")
+
+// decodeState is the inverse of encodeState, for a record of the given
+// version. It returns errBadState if the record is malformed.
+func (vs *vStorage) decodeState(version int, buffer []byte) error {
+	switch version {
+	case 0:
+		return vs.decodeStateV0(buffer)
+	case 1:
+	default:
+		return errBadState
+	}
+	var err error
+	get := func() uint64 {
+		if err != nil {
+			return 0
+		}
+		x, n := binary.Uvarint(buffer)
+		if n <= 0 {
+			err = errBadState
+			return 0
+		}
+		buffer = buffer[n:]
+		return x
+	}
+	vs.Sequence = get()
+	vs.Size = int64(get())
+	vs.CurrentFileNumber = int(get())
+	vs.Offset = int(get())
+	for i := 0; i < LEVEL; i++ {
+		vs.Level[i].Start = int(get())
+		vs.Level[i].End = int(get())
+		vs.Level[i].Offset = int(get())
+	}
+	n := get()
+	if err == nil && n > uint64(len(buffer)) {
+		// Every file stat takes four bytes at least.
+		err = errBadState
+	}
+	files := make(map[fileKey]*fileStat)
+	for ; n > 0 && err == nil; n-- {
+		key := fileKey{Level: int(get()), Number: int(get())}
+		files[key] = &fileStat{Size: int64(get()), Dead: int64(get())}
+	}
+	if err == nil && len(buffer) != 0 {
+		err = errBadState
+	}
+	vs.Files = files
+	return err
+}
+
+// decodeStateV0 decodes a version 0 state record.
+func (vs *vStorage) decodeStateV0(buffer []byte) error {
+	if !validStateV0(buffer) {
+		return errBadState
+	}
+	vs.Sequence = uint64(binary.BigEndian.Uint32(buffer[0:]))
+	vs.Size = int64(binary.BigEndian.Uint64(buffer[4:]))
+	vs.CurrentFileNumber = int(binary.BigEndian.Uint32(buffer[12:]))
+	vs.Offset = int(binary.BigEndian.Uint32(buffer[16:]))
+	for i := 0; i < LEVEL; i++ {
+		vs.Level[i].Start = int(binary.BigEndian.Uint32(buffer[20+i*12:]))
+		vs.Level[i].End = int(binary.BigEndian.Uint32(buffer[20+i*12+4:]))
+		vs.Level[i].Offset = int(binary.BigEndian.Uint32(buffer[20+i*12+8:]))
+	}
+	vs.Files = nil
+	if len(buffer) < ManifestSize+4 {
+		return nil
+	}
+	n := int(binary.BigEndian.Uint32(buffer[ManifestSize:]))
+	vs.Files = make(map[fileKey]*fileStat, n)
+	for o := ManifestSize + 4; n > 0; n, o = n-1, o+fileStatLen {
+		key := fileKey{
+			Level:  int(binary.BigEndian.Uint32(buffer[o:])),
+			Number: int(binary.BigEndian.Uint32(buffer[o+4:])),
+		}
+		vs.Files[key] = &fileStat{
+			Size: int64(binary.BigEndian.Uint64(buffer[o+8:])),
+			Dead: int64(binary.BigEndian.Uint64(buffer[o+16:])),
+		}
+	}
+	return nil
+}
+
+// validStateV0 reports whether the given version 0 state record is well
+// formed.
+func validStateV0(buffer []byte) bool {
+	if len(buffer) == ManifestSize {
+		return true
+	}
+	if len(buffer) < ManifestSize+4 {
+		return false
+	}
+	n := int(binary.BigEndian.Uint32(buffer[ManifestSize:]))
+	return len(buffer) == ManifestSize+4+n*fileStatLen
+}
+
+// validState reports whether the given state record of the given version
+// is well formed.
+func validState(version int, buffer []byte) bool {
+	scratch := &vStorage{Level: make([]Level, LEVEL)}
+	return scratch.decodeState(version, buffer) == nil
+}
+
+// loadManifest restores the state from the last intact record of the
+// newest manifest that has one. It returns false if there is no such
+// record.
+func (vs *vStorage) loadManifest() (bool, error) {
+	fds, err := vs.Stor.List(storage.TypeValueManifest)
+	if err != nil {
+		return false, err
+	}
+	sort.Slice(fds, func(i, j int) bool {
+		return fds[i].Num > fds[j].Num
+	})
+	// A manifest whose first record never made it to disk is skipped, the
+	// previous one is only removed once that record is synced.
+	for _, fd := range fds {
+		version, state, err := vs.readManifest(fd)
+		if err != nil {
+			return false, err
+		}
+		if state != nil {
+			return true, vs.decodeState(version, state)
+		}
+	}
+	return false, nil
+}
+
+// readManifest returns the format version and the last intact state record
+// of the given manifest, or a nil record if there is no such record.
+func (vs *vStorage) readManifest(fd storage.FileDesc) (version int, state []byte, err error) {
+	f, err := vs.Stor.Open(fd)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+
+	var (
+		jr    = journal.NewReader(f, nil, false, true)
+		buf   = &bytes.Buffer{}
+		first = true
+	)
+	for {
+		r, err := jr.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, nil, err
+		}
+		buf.Reset()
+		if _, err := buf.ReadFrom(r); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				first = false
+				continue
+			}
+			return 0, nil, err
+		}
+		if first {
+			first = false
+			if v, ok := parseFormatRecord(buf.Bytes()); ok {
+				if v > vManifestVersion {
+					return 0, nil, fmt.Errorf("leveldb: unsupported value log format version %d", v)
+				}
+				version = v
+				continue
+			}
+		}
+		if validState(version, buf.Bytes()) {
+			state = append(state[:0], buf.Bytes()...)
+		}
+	}
+	return version, state, nil
+}
+
+// createManifest starts a new manifest holding the current state. The
+// older manifests are removed once it is synced, so there is an intact
+// manifest at any point in time.
+func (vs *vStorage) createManifest() error {
+	fds, err := vs.Stor.List(storage.TypeValueManifest)
+	if err != nil {
+		return err
+	}
+	fd := storage.FileDesc{Type: storage.TypeValueManifest, Num: vs.ManifestNumber + 1}
+	for _, old := range fds {
+		if old.Num >= fd.Num {
+			fd.Num = old.Num + 1
+		}
+	}
+	w, err := vs.Stor.Create(fd)
+	if err != nil {
+		return err
+	}
+	vs.ManifestFile = w
+	vs.ManifestWriter = journal.NewWriter(w)
+	if err := vs.writeFormat(); err != nil {
+		w.Close()
+		return err
+	}
+	if err := vs.logState(); err != nil {
+		w.Close()
+		return err
+	}
+	vs.ManifestNumber = fd.Num
+	// An older manifest left behind is harmless, the newest one is read.
+	for _, old := range fds {
+		vs.Stor.Remove(old)
+	}
+	return nil
+}
+
+// writeFormat appends the format record to a new manifest.
+func (vs *vStorage) writeFormat() error {
+	w, err := vs.ManifestWriter.Next()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(formatRecord())
+	return err
+}
+
+// logState appends the current state to the manifest. The caller must
+// hold the mutex, unless the value log is not shared yet.
+func (vs *vStorage) logState() error {
+	w, err := vs.ManifestWriter.Next()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(vs.encodeState()); err != nil {
+		return err
+	}
+	if err := vs.ManifestWriter.Flush(); err != nil {
+		return err
+	}
+	return vs.ManifestFile.Sync()
+}
+
+// retire queues a compacted value file for removal, see obsoleteFile.
+func (vs *vStorage) retire(file fileKey) {
+	vs.queueObsolete([]obsoleteFile{{File: file, Seq: vs.KeyStore.getSeq()}})
+	vs.removeObsolete(vs.KeyStore.minSeq())
+}
+
+// hasObsolete reports whether any obsolete file is queued, without locking.
+func (vs *vStorage) hasObsolete() bool {
+	return atomic.LoadInt32(&vs.obsoleteN) != 0
+}
+
+// removeObsolete removes the obsolete files that no snapshot at or above
+// minSeq can refer to. A file that fails to be removed is kept queued.
+func (vs *vStorage) removeObsolete(minSeq uint64) {
+	vs.removeFiles(vs.takeObsolete(minSeq))
+}
+
+// releaseObsolete is removeObsolete for whoever released the oldest
+// snapshot: it returns without locking if nothing is queued, and the files
+// are removed in the background. Once the DB is closed they are left
+// queued, for Close or else the next open to remove.
+func (vs *vStorage) releaseObsolete(minSeq uint64) {
+	if !vs.hasObsolete() {
+		return
+	}
+	files := vs.takeObsolete(minSeq)
+	if len(files) == 0 {
+		return
+	}
+	if db := vs.KeyStore; db == nil || !db.goTracked(func() { vs.removeFiles(files) }) {
+		vs.queueObsolete(files)
+	}
+}
+
+// takeObsolete unqueues and returns the obsolete files that no snapshot at
+// or above minSeq can refer to.
+func (vs *vStorage) takeObsolete(minSeq uint64) []obsoleteFile {
+	if !vs.hasObsolete() {
+		return nil
+	}
+	var removable []obsoleteFile
+	vs.Mutex.Lock()
+	n := 0
+	for _, f := range vs.Obsolete {
+		if f.Seq <= minSeq {
+			removable = append(removable, f)
+			continue
+		}
+		vs.Obsolete[n] = f
+		n++
+	}
+	vs.Obsolete = vs.Obsolete[:n]
+	atomic.StoreInt32(&vs.obsoleteN, int32(n))
+	vs.Mutex.Unlock()
+	return removable
+}
+
+// queueObsolete queues the given obsolete files again.
+func (vs *vStorage) queueObsolete(files []obsoleteFile) {
+	vs.Mutex.Lock()
+	vs.Obsolete = append(vs.Obsolete, files...)
+	atomic.StoreInt32(&vs.obsoleteN, int32(len(vs.Obsolete)))
+	vs.Mutex.Unlock()
+}
+
+// removeFiles removes the given obsolete files, without holding the mutex.
+// A file that fails to be removed is queued again.
+func (vs *vStorage) removeFiles(removable []obsoleteFile) {
+	var failed []obsoleteFile
+	for _, f := range removable {
+		// No reader refers to the file anymore, close its cached handle.
+		vs.fcache.Evict(uint64(f.File.Level), uint64(f.File.Number))
+		if vs.vcache != nil {
+			vs.vcache.EvictNS(valueCacheNS(f.File.Level, f.File.Number))
+		}
+		fd := valueFileDesc(f.File.Level, f.File.Number)
+		err := vs.Stor.Remove(fd)
+		if err == nil || os.IsNotExist(err) {
+			continue
+		}
+		vs.logf("valuelog@remove error %s %q", fd, err)
+		failed = append(failed, f)
+	}
+	if len(failed) > 0 {
+		vs.queueObsolete(failed)
+	}
+}
+
+// Close syncs the value files and records the final state in the manifest,
+// unless the value log is read-only. It waits for a running compaction to
+// stop first, so the KeyStore must be closed already, if any. The storage
+// is left open, unless it was opened along with the DB by OpenFile.
+func (vs *vStorage) Close() error {
+	// Held for good, no compaction starts after Close.
+	vs.gcSem <- struct{}{}
+
+	// No snapshot survives Close.
+	vs.removeObsolete(^uint64(0))
+	vs.fcache.Close()
+	vs.bpool.Close()
+	if vs.vcache != nil {
+		vs.vcache.CloseWeak()
+	}
+	vs.Mutex.Lock()
+	defer vs.Mutex.Unlock()
+	var err error
+	if vs.CurrentFile != nil {
+		err = vs.CurrentFile.Sync()
+		if err1 := vs.CurrentFile.Close(); err == nil {
+			err = err1
+		}
+	}
+	for _, w := range vs.CompactFiles {
+		if err1 := w.Sync(); err == nil {
+			err = err1
+		}
+		if err1 := w.Close(); err == nil {
+			err = err1
+		}
+	}
+	if !vs.ReadOnly {
+		if err1 := vs.logState(); err == nil {
+			err = err1
+		}
+		if err1 := vs.ManifestWriter.Close(); err == nil {
+			err = err1
+		}
+		if err1 := vs.ManifestFile.Close(); err == nil {
+			err = err1
+		}
+	}
+	if vs.closer != nil {
+		if err1 := vs.closer.Close(); err == nil {
+			err = err1
+		}
+	}
+	return err
+}
+
+func (vs *vStorage) logf(format string, v ...interface{}) {
+	if vs.KeyStore != nil {
+		vs.KeyStore.logf(format, v...)
+	}
+}
+
+// relocation is a value record copied by compaction, see DB.relocateRecs.
+type relocation struct {
+	key, from, to []byte
+	applied       bool // Set by DB.relocateRecs.
+}
+
+// relocateBatchSize is the number of relocations committed at once.
+const relocateBatchSize = 1024
+
+// markDead accounts the records at the given locations as dead. Locations
+// into files that are gone already are ignored.
+func (vs *vStorage) markDead(locations [][]byte) error {
+	err := vs.addDead(locations, 1)
+	vs.maybeCompact()
+	return err
+}
+
+// markLive undoes markDead, for records that are referenced again.
+func (vs *vStorage) markLive(locations [][]byte) error {
+	return vs.addDead(locations, -1)
+}
+
+func (vs *vStorage) addDead(locations [][]byte, sign int64) error {
+	if len(locations) == 0 {
+		return nil
+	}
+	vs.Mutex.Lock()
+	defer vs.Mutex.Unlock()
+	for _, location := range locations {
+		length, fileNumber, _, _, level, ok := parseLocation(location)
+		if !ok {
+			continue
+		}
+		if stat := vs.Files[fileKey{level, fileNumber}]; stat != nil {
+			// A recount in between may have accounted the records already.
+			n := sign * int64(length)
+			if stat.Dead+n < 0 {
+				n = -stat.Dead
+			} else if stat.Dead+n > stat.Size {
+				n = stat.Size - stat.Dead
+			}
+			stat.Dead += n
+			atomic.AddInt64(&vs.Dead, n)
+		}
+	}
+	return vs.logState()
+}
+
+// maybeCompact starts a compaction if the value log grew past the warning
+// line and there is something to reclaim, unless background compaction is
+// paused or a compaction is running already. The dead bytes are recounted
+// first if they are unknown.
+func (vs *vStorage) maybeCompact() {
+	if vs.ReadOnly || atomic.LoadInt32(&vs.gcPaused) != 0 {
+		return
+	}
+	vs.Mutex.Lock()
+	recount := vs.Recount
+	vs.Mutex.Unlock()
+	if recount {
+		vs.maybeRecount()
+		return
+	}
+	if atomic.LoadInt64(&vs.Size) <= vs.WarningLine || atomic.LoadInt64(&vs.Dead) <= 0 {
+		return
+	}
+	vs.startGC("compaction", func(ctx context.Context) error {
+		return vs.compact(ctx, false)
+	})
+}
+
+// maybeRecount starts recounting the dead bytes if they are unknown, see
+// recount. A compaction may follow.
+func (vs *vStorage) maybeRecount() {
+	vs.Mutex.Lock()
+	recount := vs.Recount
+	vs.Mutex.Unlock()
+	if vs.ReadOnly || !recount {
+		return
+	}
+	vs.startGC("recount", func(ctx context.Context) error {
+		if err := vs.recount(ctx); err != nil {
+			return err
+		}
+		if atomic.LoadInt32(&vs.gcPaused) != 0 || atomic.LoadInt64(&vs.Size) <= vs.WarningLine {
+			return nil
+		}
+		return vs.compact(ctx, false)
+	})
+}
+
+// startGC runs f in the background holding gcSem, unless it is held
+// already. The goroutine is tracked by the closeW of the DB and f is passed
+// a context that is done once the DB is closed.
+func (vs *vStorage) startGC(name string, f func(ctx context.Context) error) {
+	db := vs.KeyStore
+	if db == nil {
+		return
+	}
+	select {
+	case vs.gcSem <- struct{}{}:
+	default:
+		return
+	}
+	if !db.goTracked(func() {
+		if err := f(closeContext{db}); err != nil && err != ErrClosed {
+			vs.logf("valuelog@%s error %q", name, err)
+		}
+		<-vs.gcSem
+	}) {
+		<-vs.gcSem
+	}
+}
+
+// closeContext is a context that is done once the DB is closed.
+type closeContext struct {
+	db *DB
+}
+
+func (c closeContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (c closeContext) Done() <-chan struct{} {
+	return c.db.closeC
+}
+
+func (c closeContext) Err() error {
+	select {
+	case <-c.db.closeC:
+		return ErrClosed
+	default:
+		return nil
+	}
+}
+
+func (c closeContext) Value(key interface{}) interface{} {
+	return nil
+}
+
+// compactAll recounts the dead bytes and compacts every value file that
+// holds garbage, see recount and compact. It waits for a running compaction
+// to finish first.
+func (vs *vStorage) compactAll(ctx context.Context) error {
+	if vs.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case vs.gcSem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() {
+		<-vs.gcSem
+	}()
+	if err := vs.recount(ctx); err != nil {
+		return err
+	}
+	return vs.compact(ctx, true)
+}
+
+// recount recomputes the dead bytes of every value file from the records
+// the LSM refers to, the versions kept for snapshots included. The dead
+// bytes are lost whenever the state is rebuilt from the value files, and
+// are off if the process died between appending records and committing the
+// keys referring to them, or between dropping keys and accounting their
+// records.
+//
+// Writes and table compaction are held off while the LSM iterator is taken,
+// so that every record is either referred to by it or accounted dead by
+// then. The caller must hold gcSem.
+func (vs *vStorage) recount(ctx context.Context) error {
+	db := vs.KeyStore
+
+	// Acquire write lock.
+	select {
+	case db.writeLockC <- struct{}{}:
+	case err := <-db.compPerErrC:
+		return err
+	case <-db.closeC:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// Pause table compaction.
+	resumeC := make(chan struct{})
+	select {
+	case db.tcompPauseC <- (chan<- struct{})(resumeC):
+	case <-db.closeC:
+		<-db.writeLockC
+		return ErrClosed
+	}
+
+	iter := db.newRawIterator(nil, nil, nil, nil)
+	defer iter.Release()
+	base := make(map[fileKey]fileStat)
+	vs.Mutex.Lock()
+	for key, stat := range vs.Files {
+		base[key] = *stat
+	}
+	vs.Mutex.Unlock()
+
+	// Resume table compaction and writes.
+	select {
+	case <-resumeC:
+	case <-db.closeC:
+	}
+	<-db.writeLockC
+
+	live := make(map[fileKey]int64)
+	for iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, _, kt, err := parseInternalKey(iter.Key()); err != nil || kt != keyTypeVal {
+			continue
+		}
+		if length, fileNumber, _, _, level, ok := parseLocation(iter.Value()); ok {
+			live[fileKey{level, fileNumber}] += int64(length)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	vs.Mutex.Lock()
+	defer vs.Mutex.Unlock()
+	for key, b := range base {
+		stat := vs.Files[key]
+		if stat == nil {
+			continue
+		}
+		// Records appended since are live, those dropped since are
+		// accounted already.
+		dead := b.Size - live[key] + stat.Dead - b.Dead
+		if dead < 0 {
+			dead = 0
+		} else if dead > stat.Size {
+			dead = stat.Size
+		}
+		atomic.AddInt64(&vs.Dead, dead-stat.Dead)
+		stat.Dead = dead
+	}
+	// Only now are the dead bytes known; a recount cut short is retried,
+	// see maybeCompact.
+	vs.Recount = false
+	return vs.logState()
+}
+
+// setPaused pauses or resumes background compaction. A running background
+// compaction stops once done with the file at hand.
+func (vs *vStorage) setPaused(paused bool) {
+	if paused {
+		atomic.StoreInt32(&vs.gcPaused, 1)
+	} else {
+		atomic.StoreInt32(&vs.gcPaused, 0)
+		vs.maybeCompact()
+	}
+}
+
+// pickVictim returns the complete value file with the most dead bytes. The
+// files still appended to, the current file and the output files of
+// compaction, are never picked.
+func (vs *vStorage) pickVictim() (victim fileKey, ok bool) {
+	vs.Mutex.Lock()
+	defer vs.Mutex.Unlock()
+	var dead int64
+	for key, stat := range vs.Files {
+		if stat.Dead <= dead {
+			continue
+		}
+		if key.Level == 0 && key.Number == vs.CurrentFileNumber {
+			continue
+		}
+		if vs.CompactFiles[key.Level] != nil && key.Number == vs.Level[key.Level].End {
+			continue
+		}
+		victim, dead, ok = key, stat.Dead, true
+	}
+	return
+}
+
+// compact rewrites the value files with the most garbage first, until the
+// total size falls below the safe line or no file is known to hold any
+// garbage; or, if all is set, until no file is known to hold any garbage.
+// A background compaction, that is one without all set, also stops once
+// paused. The caller must hold gcSem.
+//
+// A file is only retired once all of its live records are relocated, so on
+// error nothing is lost; the copies that failed to be committed are
+// accounted dead.
+func (vs *vStorage) compact(ctx context.Context, all bool) error {
+	atomic.AddUint32(&vs.gcRuns, 1)
+	start := time.Now()
+	defer func() {
+		atomic.AddInt64(&vs.gcDuration, int64(time.Since(start)))
+	}()
+	limiter := &gcLimiter{rate: int64(vs.gcRate), start: start}
+	for all || atomic.LoadInt64(&vs.Size) > vs.SafeLine {
+		if !all && atomic.LoadInt32(&vs.gcPaused) != 0 {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		victim, ok := vs.pickVictim()
+		if !ok {
+			return nil
+		}
+		if err := vs.compactFile(ctx, victim, limiter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gcLimiter paces the I/O of a compaction to a rate in bytes per second.
+type gcLimiter struct {
+	rate  int64 // No limit if zero.
+	start time.Time
+	n     int64
+}
+
+// wait accounts n bytes of I/O and sleeps until the I/O done so far is
+// within the rate, or until ctx is done.
+func (l *gcLimiter) wait(ctx context.Context, n int) error {
+	if l.rate <= 0 {
+		return nil
+	}
+	l.n += int64(n)
+	d := time.Duration(float64(l.n)/float64(l.rate)*float64(time.Second)) - time.Since(l.start)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// compactFile moves the live records of the given file into the next level.
+//
+// The copied records are made durable and then committed in batches through
+// DB.relocateRecs, which only repoints keys that still refer to the old
+// location. The file is retired once all of its records are committed.
+//
+// The records are appended to the output file of the level, which is kept
+// open for later compactions; a new one is started after it fills up or a
+// write to it fails, and after the value log is reopened.
+//
+// If ctx is done the records copied so far are committed and the file is
+// left as is.
+func (vs *vStorage) compactFile(ctx context.Context, victim fileKey, limiter *gcLimiter) error {
+	out := victim.Level + 1
+	if out >= LEVEL {
+		out = LEVEL - 1
+	}
+	vs.Mutex.Lock()
+	wFile, err := vs.compactOutput(out)
+	wNum, wOffset := vs.Level[out].End, vs.Level[out].Offset
+	var size int64
+	if stat := vs.Files[victim]; stat != nil {
+		size = stat.Size
+	}
+	vs.Mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	sync := !vs.KeyStore.s.o.GetNoSync()
+	var (
+		rels      []relocation
+		relocated int64
+	)
+	commit := func() error {
+		if len(rels) == 0 {
+			return nil
+		}
+		// The copies must be durable before any key points to them.
+		if err := wFile.Sync(); err != nil {
+			return err
+		}
+		if _, err := vs.KeyStore.relocateRecs(rels, sync); err != nil {
+			dead := make([][]byte, len(rels))
+			for i, rel := range rels {
+				dead[i] = rel.to
+			}
+			rels = rels[:0]
+			if derr := vs.markDead(dead); derr != nil {
+				vs.logf("valuelog@compaction accounting error %q", derr)
+			}
+			return err
+		}
+		// The copies of the records overwritten in the meantime are dead.
+		var dead [][]byte
+		for _, rel := range rels {
+			length, _, _, _, _, _ := parseLocation(rel.to)
+			if rel.applied {
+				relocated += int64(length)
+			} else {
+				dead = append(dead, rel.to)
+			}
+		}
+		rels = rels[:0]
+		return vs.markDead(dead)
+	}
+
+	// stop commits the records copied so far before giving up with err.
+	stop := func(err error) error {
+		if cerr := commit(); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+
+	rFile, err := vs.Stor.Open(valueFileDesc(victim.Level, victim.Number))
+	if err != nil {
+		return err
+	}
+	defer rFile.Close()
+	// Whatever lies past the size is the remainder of a failed write.
+	rr := newRecordReader(io.LimitReader(rFile, size), 0, size)
+	for {
+		if err := ctx.Err(); err != nil {
+			return stop(err)
+		}
+		offset := rr.offset
+		record, err := rr.next()
+		if err == io.EOF {
+			break
+		} else if err == errBadRecord {
+			return newErrValueCorrupted(victim.Level, victim.Number, offset, "bad record")
+		} else if err != nil {
+			return err
+		}
+		length := len(record)
+		atomic.AddUint64(&vs.ioRead, uint64(length))
+		if err := limiter.wait(ctx, length); err != nil {
+			return stop(err)
+		}
+		key := recordKey(record)
+		from := recordLocation(record, victim.Level, victim.Number, offset)
+
+		// Skip the records already superseded; the rest is checked again
+		// by relocateRecs under the write lock.
+		se := vs.KeyStore.acquireSnapshot()
+		location, err := vs.KeyStore.get(nil, nil, key, se.seq, nil)
+		vs.KeyStore.releaseSnapshot(se)
+		if err == ErrNotFound || (err == nil && !bytes.Equal(location, from)) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		// The copy gets a uint64 seq, even if the record has none.
+		vs.Mutex.Lock()
+		nseq := vs.Sequence
+		vs.Sequence += 1
+		vs.Mutex.Unlock()
+		record = setRecordSeq(record, nseq)
+		setRecordChecksum(record)
+		n := len(record)
+		atomic.AddUint64(&vs.ioWrite, uint64(n))
+		if _, err := wFile.Write(record); err != nil {
+			err = stop(err)
+			vs.Mutex.Lock()
+			vs.closeCompactOutput(out)
+			vs.Mutex.Unlock()
+			return err
+		}
+		to := recordLocation(record, out, wNum, wOffset)
+		rels = append(rels, relocation{key: key, from: from, to: to})
+		wOffset += n
+		vs.Mutex.Lock()
+		vs.Level[out].Offset = wOffset
+		vs.Files[fileKey{out, wNum}].Size += int64(n)
+		atomic.AddInt64(&vs.Size, int64(n))
+		vs.Mutex.Unlock()
+		if err := limiter.wait(ctx, n); err != nil {
+			return stop(err)
+		}
+
+		if len(rels) >= relocateBatchSize || wOffset >= vs.FileSize {
+			if err := commit(); err != nil {
+				return err
+			}
+		}
+		if wOffset >= vs.FileSize {
+			vs.Mutex.Lock()
+			vs.closeCompactOutput(out)
+			wFile, err = vs.compactOutput(out)
+			wNum, wOffset = vs.Level[out].End, 0
+			vs.Mutex.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := commit(); err != nil {
+		return err
+	}
+
+	vs.Mutex.Lock()
+	if stat := vs.Files[victim]; stat != nil {
+		atomic.AddInt64(&vs.Size, -stat.Size)
+		atomic.AddInt64(&vs.gcRelocated, relocated)
+		atomic.AddInt64(&vs.gcReclaimed, stat.Size-relocated)
+		atomic.AddInt64(&vs.Dead, -stat.Dead)
+		delete(vs.Files, victim)
+	}
+	vs.updateStart(victim.Level)
+	err = vs.logState()
+	vs.Mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	vs.retire(victim)
+	return nil
+}
+
+// compactOutput returns the output file of compaction at the given level,
+// creating it if needed. The caller must hold the mutex.
+func (vs *vStorage) compactOutput(level int) (storage.Writer, error) {
+	if w := vs.CompactFiles[level]; w != nil {
+		return w, nil
+	}
+	w, err := vs.createFile(level)
+	if err != nil {
+		return nil, err
+	}
+	vs.CompactFiles[level] = w
+	return w, vs.logState()
+}
+
+// closeCompactOutput closes the output file of compaction at the given
+// level, the file is not appended to anymore. The caller must hold the
+// mutex.
+func (vs *vStorage) closeCompactOutput(level int) {
+	if w := vs.CompactFiles[level]; w != nil {
+		w.Close()
+		delete(vs.CompactFiles, level)
+	}
+}
+
+// SetKeyStore sets the DB the value log belongs to, and starts recounting
+// the dead bytes if they are unknown.
+func (vs *vStorage) SetKeyStore(keyStore *DB) {
+	vs.KeyStore = keyStore
+	vs.maybeRecount()
+}
+
+// valueLevelStat sums up the value files of a level.
+type valueLevelStat struct {
+	Files      int
+	Size, Dead int64
+}
+
+// levelStats returns the statistics of each level up to the last level
+// that has value files.
+func (vs *vStorage) levelStats() []valueLevelStat {
+	vs.Mutex.Lock()
+	defer vs.Mutex.Unlock()
+	stats := make([]valueLevelStat, LEVEL)
+	n := 0
+	for key, stat := range vs.Files {
+		s := &stats[key.Level]
+		s.Files++
+		s.Size += stat.Size
+		s.Dead += stat.Dead
+		if key.Level >= n {
+			n = key.Level + 1
+		}
+	}
+	return stats[:n]
+}
@@ -0,0 +1,318 @@
+package leveldb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// Databases written before values were tagged keep an untagged location in
+// the LSM for every value, laid out as a valueTagPointer location without
+// the tag. Their value log has a bare state record as manifest and records
+// with a 16-byte header (length, keyLen, valueLen, seq) and no checksum.
+//
+// Such a value log is moved aside when the DB is opened and all values are
+// migrated into a fresh value log within a single transaction, so either all
+// keys point into the new value log or none does.
+const (
+	legacyLocationLen     = 20
+	legacyRecordHeaderLen = 16
+	legacySuffix          = ".legacy"
+	legacyObsoleteSuffix  = ".legacy.obsolete"
+	legacyMarker          = "MIGRATE"
+)
+
+// prepareLegacyValues moves a legacy value log at valuePath out of the way
+// and returns the path it was moved to, or an empty string if there is no
+// legacy value log to migrate. A migration interrupted by a crash is picked
+// up again. A value log that needs migrating can't be opened read-only.
+func prepareLegacyValues(valuePath string, readOnly bool) (string, error) {
+	// Left over by a migration that committed.
+	if !readOnly {
+		if err := os.RemoveAll(valuePath + legacyObsoleteSuffix); err != nil {
+			return "", err
+		}
+	}
+
+	legacyPath := valuePath + legacySuffix
+	if _, err := os.Stat(legacyPath); err == nil {
+		if readOnly {
+			return "", ErrReadOnly
+		}
+		// The values written by the interrupted migration are garbage, they
+		// are accounted dead once the migration completes.
+		return legacyPath, nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	legacy, err := isLegacyValues(valuePath)
+	if err != nil || !legacy {
+		return "", err
+	}
+	if readOnly {
+		return "", ErrReadOnly
+	}
+	if err := os.Rename(valuePath, legacyPath); err != nil {
+		return "", err
+	}
+	return legacyPath, nil
+}
+
+// isLegacyValues reports whether the value log at valuePath is a legacy one.
+// A legacy value log has no journaled manifest, and its bare manifest is only
+// written on close; so it is told by its records if there are any, by its
+// manifest otherwise. A value log that is neither is reported as corrupted
+// rather than guessed at.
+func isLegacyValues(valuePath string) (bool, error) {
+	fis, err := ioutil.ReadDir(valuePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	var (
+		manifest          os.FileInfo
+		legacy, current   int
+		unknown           = -1
+		unknownFileNumber int
+	)
+	for _, fi := range fis {
+		name := fi.Name()
+		if strings.HasPrefix(name, "VMANIFEST-") {
+			return false, nil
+		}
+		if name == Manifest {
+			manifest = fi
+			continue
+		}
+		var level, fileNumber int
+		if n, _ := fmt.Sscanf(name, "level_%d_number_%d.value", &level, &fileNumber); n != 2 || name != fmt.Sprintf("level_%d_number_%d.value", level, fileNumber) {
+			continue
+		}
+		format, err := legacyFileFormat(path.Join(valuePath, name))
+		if err != nil {
+			return false, err
+		}
+		switch format {
+		case legacyFormat:
+			legacy++
+		case currentFormat:
+			current++
+		case unknownFormat:
+			unknown, unknownFileNumber = level, fileNumber
+		}
+	}
+	switch {
+	case legacy > 0 && current > 0:
+		return false, newErrValueCorrupted(-1, -1, -1, "legacy and current value files mixed")
+	case legacy > 0:
+		return true, nil
+	case current > 0:
+		return false, nil
+	case manifest != nil:
+		// A journaled manifest is never exactly one bare state record long.
+		return manifest.Size() == ManifestSize, nil
+	case unknown >= 0:
+		return false, newErrValueCorrupted(unknown, unknownFileNumber, 0, "unknown value file format")
+	}
+	return false, nil
+}
+
+// Value file formats, see legacyFileFormat.
+const (
+	emptyFormat = iota
+	legacyFormat
+	currentFormat
+	unknownFormat
+)
+
+// legacyFileFormat tells the format of the given value file by its first
+// record. A file whose first record is torn has an unknown format.
+func legacyFileFormat(name string) (int, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+	if size == 0 {
+		return emptyFormat, nil
+	}
+	var header [legacyRecordHeaderLen]byte
+	if _, err := io.ReadFull(f, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return unknownFormat, nil
+		}
+		return 0, err
+	}
+	if length := int64(binary.BigEndian.Uint32(header[4:])); length >= vRecordHeaderLen && length <= size {
+		record := make([]byte, length)
+		if _, err := f.ReadAt(record, 0); err != nil {
+			return 0, err
+		}
+		if validRecord(record) {
+			return currentFormat, nil
+		}
+	}
+	length := int64(binary.BigEndian.Uint32(header[0:]))
+	keyLen := int64(binary.BigEndian.Uint32(header[4:]))
+	valueLen := int64(binary.BigEndian.Uint32(header[8:]))
+	if length == legacyRecordHeaderLen+keyLen+valueLen && length <= size {
+		return legacyFormat, nil
+	}
+	return unknownFormat, nil
+}
+
+// migrateLegacyValues rewrites every value of the DB from the legacy value
+// log at legacyPath into the current value log, then removes the legacy
+// value log. It must be called before the DB is used.
+func (db *DB) migrateLegacyValues(legacyPath string) (err error) {
+	obsoletePath := legacyPath[:len(legacyPath)-len(legacySuffix)] + legacyObsoleteSuffix
+
+	// The marker holds the sequence number the migration started at; the
+	// DB is not written to otherwise before the migration completes, so a
+	// greater sequence number means the migration committed.
+	markerPath := path.Join(legacyPath, legacyMarker)
+	var resumed bool
+	if marker, err := ioutil.ReadFile(markerPath); err == nil && len(marker) == 8 {
+		if db.getSeq() > binary.BigEndian.Uint64(marker) {
+			if err := os.Rename(legacyPath, obsoletePath); err != nil {
+				return err
+			}
+			return os.RemoveAll(obsoletePath)
+		}
+		resumed = true
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	marker := make([]byte, 8)
+	binary.BigEndian.PutUint64(marker, db.getSeq())
+	if err := writeFileSync(markerPath, marker); err != nil {
+		return err
+	}
+
+	db.logf("db@migrate migrating legacy value log %s", legacyPath)
+
+	files := make(map[string]*os.File)
+	sizes := make(map[string]int64)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	get := func(location []byte) ([]byte, error) {
+		length := int(binary.BigEndian.Uint32(location[0:]))
+		fileNumber := int(binary.BigEndian.Uint32(location[4:]))
+		offset := int(binary.BigEndian.Uint32(location[8:]))
+		level := int(binary.BigEndian.Uint32(location[16:]))
+		if length < legacyRecordHeaderLen {
+			return nil, newErrValueCorrupted(level, fileNumber, offset, fmt.Sprintf("invalid legacy record length %d", length))
+		}
+		name := path.Join(legacyPath, fmt.Sprintf("level_%d_number_%d.value", level, fileNumber))
+		f, ok := files[name]
+		if !ok {
+			var err error
+			if f, err = os.Open(name); err != nil {
+				if os.IsNotExist(err) {
+					return nil, newErrValueCorrupted(level, fileNumber, offset, "missing legacy value file")
+				}
+				return nil, err
+			}
+			fi, err := f.Stat()
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+			files[name], sizes[name] = f, fi.Size()
+		}
+		if int64(offset)+int64(length) > sizes[name] {
+			return nil, newErrValueCorrupted(level, fileNumber, offset, "truncated legacy record")
+		}
+		record := make([]byte, length)
+		if _, err := f.ReadAt(record, int64(offset)); err != nil {
+			if err == io.EOF {
+				return nil, newErrValueCorrupted(level, fileNumber, offset, "truncated legacy record")
+			}
+			return nil, err
+		}
+		keyLen := int(binary.BigEndian.Uint32(record[4:]))
+		valueLen := int(binary.BigEndian.Uint32(record[8:]))
+		if int(binary.BigEndian.Uint32(record[0:])) != length || legacyRecordHeaderLen+keyLen+valueLen != length {
+			return nil, newErrValueCorrupted(level, fileNumber, offset, "bad legacy record")
+		}
+		return record[legacyRecordHeaderLen+keyLen:], nil
+	}
+
+	tr, err := db.OpenTransaction()
+	if err != nil {
+		return err
+	}
+	se := db.acquireSnapshot()
+	iter := db.newIterator(nil, nil, se.seq, se, nil, nil)
+	n := 0
+	for iter.Next() {
+		if len(iter.location) != legacyLocationLen {
+			err = newErrValueCorrupted(-1, -1, -1, fmt.Sprintf("invalid legacy location length %d", len(iter.location)))
+			break
+		}
+		var value []byte
+		if value, err = get(iter.location); err != nil {
+			break
+		}
+		if err = tr.Put(iter.Key(), value, nil); err != nil {
+			break
+		}
+		n++
+	}
+	if err == nil {
+		err = iter.Error()
+	}
+	iter.Release()
+	if err != nil {
+		tr.Discard()
+		return err
+	}
+	if err := tr.Commit(); err != nil {
+		return err
+	}
+	if resumed {
+		// No key refers to the values of the interrupted migration.
+		vs := db.s.vStore
+		vs.Mutex.Lock()
+		vs.Recount = true
+		vs.Mutex.Unlock()
+		vs.maybeRecount()
+	}
+
+	if err := os.Rename(legacyPath, obsoletePath); err != nil {
+		return err
+	}
+	db.logf("db@migrate migrated N·%d", n)
+	return os.RemoveAll(obsoletePath)
+}
+
+func writeFileSync(name string, data []byte) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
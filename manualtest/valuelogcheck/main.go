@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ccfarm/goleveldb/leveldb"
+	"github.com/ccfarm/goleveldb/leveldb/opt"
+)
+
+var (
+	dbPath string
+	repair bool
+)
+
+func init() {
+	flag.StringVar(&dbPath, "db", "", "Path of the DB to check")
+	flag.BoolVar(&repair, "repair", false, "Delete the keys whose values are broken")
+}
+
+func main() {
+	flag.Parse()
+
+	if dbPath == "" {
+		fmt.Println("Missing -db flag")
+		os.Exit(2)
+	}
+
+	db, err := leveldb.OpenFile(dbPath, &opt.Options{ReadOnly: !repair})
+	if err != nil {
+		fmt.Printf("Could not open DB: %s\n", err)
+		os.Exit(10)
+	}
+
+	report, err := db.VerifyValueLog(repair)
+	if err != nil {
+		fmt.Printf("Could not verify value log: %s\n", err)
+		db.Close()
+		os.Exit(11)
+	}
+	for _, p := range report.Problems {
+		fmt.Printf("%q: %s\n", p.Key, p.Err)
+	}
+	fmt.Printf("Keys: %d, separated: %d, broken: %d\n", report.Keys, report.Separated, len(report.Problems))
+	if repair {
+		fmt.Printf("Deleted: %d\n", report.Repaired)
+	}
+
+	if err := db.Close(); err != nil {
+		fmt.Printf("Error when closing DB: %s\n", err)
+		os.Exit(12)
+	}
+	if len(report.Problems) > report.Repaired {
+		os.Exit(1)
+	}
+}